@@ -0,0 +1,448 @@
+package gormfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type ArchiveFormat int
+
+const (
+	ArchiveTar ArchiveFormat = iota
+	ArchiveTarGzip
+	ArchiveZip
+)
+
+// zipUnixOwnerTag is the Info-ZIP "ux" extra field, used to keep User and Group in zip archives.
+const zipUnixOwnerTag = 0x7875
+
+// exportChunkSize is the size of the reads copying exported file contents, so that they are never
+// loaded in memory at once.
+const exportChunkSize = 1 << 20
+
+type archiveEntry struct {
+	path string
+	file *File
+}
+
+// Export writes the tree rooted at root to w. Entries are named relative to root
+// and file contents are read by chunks.
+func (f *GormFs) Export(w io.Writer, root string, format ArchiveFormat) error {
+	entries, err := f.archiveEntries(root)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case ArchiveTar:
+		return f.exportTar(w, entries)
+	case ArchiveTarGzip:
+		gw := gzip.NewWriter(w)
+		if err := f.exportTar(gw, entries); err != nil {
+			return err
+		}
+		return gw.Close()
+	case ArchiveZip:
+		return f.exportZip(w, entries)
+	default:
+		return errors.Errorf("unknown archive format %d", format)
+	}
+}
+
+// Import extracts the archive read from r below dest, creating dest if needed.
+// Existing files are overwritten.
+func (f *GormFs) Import(r io.Reader, dest string, format ArchiveFormat) error {
+	if err := f.writable("import", dest); err != nil {
+		return err
+	}
+	dest = filepath.Clean(dest)
+	if err := f.MkdirAll(dest, os.ModePerm); err != nil {
+		return errors.Wrap(err, "create destination")
+	}
+
+	switch format {
+	case ArchiveTar:
+		return f.importTar(r, dest)
+	case ArchiveTarGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return errors.Wrap(err, "open gzip stream")
+		}
+		defer gr.Close()
+		return f.importTar(gr, dest)
+	case ArchiveZip:
+		return f.importZip(r, dest)
+	default:
+		return errors.Errorf("unknown archive format %d", format)
+	}
+}
+
+func (f *GormFs) archiveEntries(root string) ([]archiveEntry, error) {
+	root = filepath.Clean(root)
+	file, err := getFile(f.table(&File{}).Omit("data"), root, f.now())
+	if err != nil {
+		return nil, err
+	}
+	if !file.IsDir {
+		return []archiveEntry{{path: filepath.Base(root), file: file}}, nil
+	}
+
+	files := []*File{}
+	if err := descendants(f.table(&File{}), root, f.now()).Omit("data").Order("name").Find(&files).Error; err != nil {
+		return nil, errors.Wrap(err, "list files")
+	}
+	entries := make([]archiveEntry, len(files))
+	for i, file := range files {
+		entries[i] = archiveEntry{path: relativeTo(root, file.Name), file: file}
+	}
+	return entries, nil
+}
+
+// archiveSize returns the size of the content of entry.
+func (f *GormFs) archiveSize(entry archiveEntry) (int64, error) {
+	if entry.file.IsDir {
+		return 0, nil
+	}
+	_, size, err := f.readRange(entry.file.Name, 0, 0)
+	return size, err
+}
+
+// copyContent writes the size bytes of the content of the file name to w, exportChunkSize at a time.
+func (f *GormFs) copyContent(w io.Writer, name string, size int64) error {
+	for off := int64(0); off < size; {
+		n := exportChunkSize
+		if size-off < int64(n) {
+			n = int(size - off)
+		}
+		chunk, _, err := f.readRange(name, off, n)
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 {
+			return errors.Errorf("%s was truncated while being read", name)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		off += int64(len(chunk))
+	}
+	return nil
+}
+
+func (f *GormFs) exportTar(w io.Writer, entries []archiveEntry) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		size, err := f.archiveSize(entry)
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:       entry.path,
+			Mode:       int64(entry.file.Mode.Perm()),
+			ModTime:    entry.file.MTime,
+			AccessTime: entry.file.ATime,
+			Uid:        entry.file.User,
+			Gid:        entry.file.Group,
+			Format:     tar.FormatPAX,
+		}
+		switch {
+		case entry.file.IsDir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case entry.file.Mode&fs.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			var link strings.Builder
+			if err := f.copyContent(&link, entry.file.Name, size); err != nil {
+				return errors.Wrapf(err, "read link %s", entry.path)
+			}
+			hdr.Linkname = link.String()
+			size = 0
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = size
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header for %s", entry.path)
+		}
+		if err := f.copyContent(tw, entry.file.Name, size); err != nil {
+			return errors.Wrapf(err, "write %s", entry.path)
+		}
+	}
+	return tw.Close()
+}
+
+func (f *GormFs) exportZip(w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		size, err := f.archiveSize(entry)
+		if err != nil {
+			return err
+		}
+
+		hdr := &zip.FileHeader{
+			Name:     entry.path,
+			Modified: entry.file.MTime,
+			Method:   zip.Deflate,
+			Extra:    zipUnixOwner(entry.file.User, entry.file.Group),
+		}
+		hdr.SetMode(entry.file.Mode)
+		if entry.file.IsDir {
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+		}
+
+		zf, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return errors.Wrapf(err, "write header for %s", entry.path)
+		}
+		if err := f.copyContent(zf, entry.file.Name, size); err != nil {
+			return errors.Wrapf(err, "write %s", entry.path)
+		}
+	}
+	return zw.Close()
+}
+
+func (f *GormFs) importTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read tar header")
+		}
+
+		meta := File{
+			Mode:  hdr.FileInfo().Mode(),
+			ATime: hdr.AccessTime,
+			MTime: hdr.ModTime,
+			User:  hdr.Uid,
+			Group: hdr.Gid,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+		default:
+			continue
+		}
+
+		name, err := importPath(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == dest {
+			continue
+		}
+		data := []byte(hdr.Linkname)
+		if hdr.Typeflag == tar.TypeReg {
+			if data, err = readEntry(tr, hdr.Size); err != nil {
+				return errors.Wrapf(err, "read %s", hdr.Name)
+			}
+		}
+		if err := f.importEntry(name, meta, data); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *GormFs) importZip(r io.Reader, dest string) error {
+	ra, size, release, err := zipReaderAt(r)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return errors.Wrap(err, "open zip archive")
+	}
+	for _, zf := range zr.File {
+		meta := File{
+			Mode:  zf.Mode(),
+			MTime: zf.Modified,
+		}
+		meta.User, meta.Group = parseZipUnixOwner(zf.Extra)
+
+		name, err := importPath(dest, zf.Name)
+		if err != nil {
+			return err
+		}
+		if name == dest {
+			continue
+		}
+		if err := f.importZipFile(name, meta, zf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *GormFs) importZipFile(name string, meta File, zf *zip.File) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return errors.Wrapf(err, "open %s", zf.Name)
+	}
+	defer rc.Close()
+	if zf.UncompressedSize64 > math.MaxInt64 {
+		return errors.Errorf("%s is too large", zf.Name)
+	}
+	data, err := readEntry(rc, int64(zf.UncompressedSize64))
+	if err != nil {
+		return errors.Wrapf(err, "read %s", zf.Name)
+	}
+	return f.importEntry(name, meta, data)
+}
+
+// readEntry reads the size bytes of the content of an entry at once, failing if it has
+// another size.
+func readEntry(r io.Reader, size int64) ([]byte, error) {
+	if size < 0 || int64(int(size)) != size {
+		return nil, errors.Errorf("invalid size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != nil && err != io.EOF {
+		if err == nil {
+			err = errors.New("content is longer than its declared size")
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// importEntry creates or overwrites name with meta and data, the content of regular files
+// and the target of links, stored in a single write.
+func (f *GormFs) importEntry(name string, meta File, data []byte) error {
+	if err := f.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+
+	if meta.Mode.IsDir() {
+		if err := f.Mkdir(name, meta.Mode.Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+	} else {
+		file, err := f.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, meta.Mode)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(data); err != nil {
+			file.Close()
+			return errors.Wrapf(err, "write %s", name)
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Chmod(name, meta.Mode); err != nil {
+		return err
+	}
+	if err := f.Chown(name, meta.User, meta.Group); err != nil {
+		return err
+	}
+	if meta.ATime.IsZero() {
+		meta.ATime = meta.MTime
+	}
+	return f.Chtimes(name, meta.ATime, meta.MTime)
+}
+
+// importPath maps an archive entry name below dest, refusing names that escape it.
+func importPath(dest, name string) (string, error) {
+	rel := path.Clean(strings.TrimPrefix(name, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", &fs.PathError{Op: "import", Path: name, Err: fs.ErrInvalid}
+	}
+	if rel == "." {
+		return dest, nil
+	}
+	return filepath.Join(dest, filepath.FromSlash(rel)), nil
+}
+
+// zipReaderAt returns random access to a zip stream, spooling it to a temporary
+// file when r does not provide it already.
+func zipReaderAt(r io.Reader) (io.ReaderAt, int64, func(), error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		if s, ok := r.(interface{ Size() int64 }); ok {
+			return ra, s.Size(), func() {}, nil
+		}
+		if s, ok := r.(interface{ Stat() (fs.FileInfo, error) }); ok {
+			if info, err := s.Stat(); err == nil {
+				return ra, info.Size(), func() {}, nil
+			}
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "gormfs-import-*.zip")
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "create spool file")
+	}
+	release := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		release()
+		return nil, 0, nil, errors.Wrap(err, "spool zip archive")
+	}
+	return tmp, size, release, nil
+}
+
+func zipUnixOwner(uid, gid int) []byte {
+	buf := make([]byte, 15)
+	binary.LittleEndian.PutUint16(buf[0:], zipUnixOwnerTag)
+	binary.LittleEndian.PutUint16(buf[2:], 11)
+	buf[4] = 1 // version
+	buf[5] = 4
+	binary.LittleEndian.PutUint32(buf[6:], uint32(uid))
+	buf[10] = 4
+	binary.LittleEndian.PutUint32(buf[11:], uint32(gid))
+	return buf
+}
+
+func parseZipUnixOwner(extra []byte) (uid, gid int) {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return 0, 0
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if tag != zipUnixOwnerTag || len(field) < 1 || field[0] != 1 {
+			continue
+		}
+		field = field[1:]
+		var ids [2]int
+		for i := range ids {
+			if len(field) < 1 || len(field) < 1+int(field[0]) {
+				return 0, 0
+			}
+			n := int(field[0])
+			var v uint64
+			for j := n; j > 0; j-- {
+				v = v<<8 | uint64(field[j])
+			}
+			ids[i] = int(v)
+			field = field[1+n:]
+		}
+		return ids[0], ids[1]
+	}
+	return 0, 0
+}
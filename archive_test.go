@@ -0,0 +1,140 @@
+package gormfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	mtime := time.Date(2021, 9, 1, 12, 30, 0, 0, time.UTC)
+
+	for name, format := range map[string]ArchiveFormat{
+		"tar":    ArchiveTar,
+		"tar.gz": ArchiveTarGzip,
+		"zip":    ArchiveZip,
+	} {
+		format := format
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			src := TestingFs(t)
+			require.NoError(t, src.MkdirAll("/data/sub", 0750))
+			require.NoError(t, afero.WriteFile(src, "/data/hello.txt", []byte("hello"), 0640))
+			require.NoError(t, afero.WriteFile(src, "/data/sub/empty", nil, 0600))
+			link, err := src.OpenFile("/data/link", os.O_CREATE|os.O_WRONLY, fs.ModeSymlink|0777)
+			require.NoError(t, err)
+			_, err = link.WriteString("hello.txt")
+			require.NoError(t, err)
+			require.NoError(t, src.Chown("/data/hello.txt", 1000, 1001))
+			for _, name := range []string{"/data/sub", "/data/hello.txt", "/data/sub/empty", "/data/link"} {
+				require.NoError(t, src.Chtimes(name, mtime, mtime))
+			}
+
+			var buf bytes.Buffer
+			require.NoError(t, src.Export(&buf, "/data", format))
+
+			dst := TestingFs(t)
+			require.NoError(t, dst.Import(bytes.NewReader(buf.Bytes()), "/restored", format))
+
+			data, err := afero.ReadFile(dst, "/restored/hello.txt")
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(data))
+
+			info, err := dst.Stat("/restored/hello.txt")
+			require.NoError(t, err)
+			require.Equal(t, fs.FileMode(0640), info.Mode())
+			require.True(t, mtime.Equal(info.ModTime()))
+			file := info.(*fileInfo).File
+			require.Equal(t, 1000, file.User)
+			require.Equal(t, 1001, file.Group)
+
+			info, err = dst.Stat("/restored/sub")
+			require.NoError(t, err)
+			require.True(t, info.IsDir())
+			require.Equal(t, fs.ModeDir|0750, info.Mode())
+
+			info, err = dst.Stat("/restored/sub/empty")
+			require.NoError(t, err)
+			require.Equal(t, int64(0), info.Size())
+
+			info, err = dst.Stat("/restored/link")
+			require.NoError(t, err)
+			require.Equal(t, fs.ModeSymlink|0777, info.Mode())
+			data, err = afero.ReadFile(dst, "/restored/link")
+			require.NoError(t, err)
+			require.Equal(t, "hello.txt", string(data))
+		})
+	}
+}
+
+func TestImportOverwrites(t *testing.T) {
+	src := TestingFs(t)
+	require.NoError(t, afero.WriteFile(src, "file", []byte("new"), 0644))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(&buf, ".", ArchiveZip))
+
+	dst := TestingFs(t)
+	require.NoError(t, afero.WriteFile(dst, "file", []byte("much older content"), 0644))
+	require.NoError(t, dst.Import(&buf, ".", ArchiveZip))
+
+	data, err := afero.ReadFile(dst, "file")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+}
+
+func TestImportRejectsEscapingPaths(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+	_, err := tw.Write([]byte("evil"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	gfs := TestingFs(t)
+	err = gfs.Import(&buf, "/dest", ArchiveTar)
+	require.Error(t, err)
+
+	_, err = gfs.Stat(filepath.Join("/", "evil"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLargeEntries(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), exportChunkSize/16*5/2)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "large", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}))
+	_, err := tw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	rec := NewRecorder()
+	gfs, err := NewGormFs(testingDB(t), WithInstrumentation(rec))
+	require.NoError(t, err)
+	require.NoError(t, gfs.Import(&buf, "/", ArchiveTar))
+
+	// the entry is stored in a single write instead of rewriting the growing row chunk by chunk
+	require.Equal(t, uint64(1), rec.Stats().Ops["write"].Count)
+	imported, err := afero.ReadFile(gfs, "/large")
+	require.NoError(t, err)
+	require.Equal(t, data, imported)
+
+	// and exported chunk by chunk
+	for _, format := range []ArchiveFormat{ArchiveTar, ArchiveZip} {
+		buf.Reset()
+		require.NoError(t, gfs.Export(&buf, "/large", format))
+		other := TestingFs(t)
+		require.NoError(t, other.Import(&buf, "/", format))
+		exported, err := afero.ReadFile(other, "/large")
+		require.NoError(t, err)
+		require.Equal(t, data, exported)
+	}
+}
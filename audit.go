@@ -0,0 +1,173 @@
+package gormfs
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditEntry is a row of the audit_entries table, one per mutating operation, see WithAudit.
+type AuditEntry struct {
+	ID    uint64 `gorm:"primaryKey"`
+	Time  time.Time
+	Actor string
+	Op    string
+	Path  string
+	// NewPath is the destination of renames and copies.
+	NewPath string
+	// Error is empty when the operation succeeded.
+	Error string
+}
+
+var auditIndexes = []Index{{Columns: []string{"time"}}, {Columns: []string{"actor"}}, {Columns: []string{"path"}}}
+
+// auditedOps are the operations recorded in the audit log.
+var auditedOps = map[string]bool{
+	"chmod": true, "chown": true, "chtimes": true, "expire": true,
+	"create": true, "mkdir": true, "mkdirall": true,
+	"write": true, "writeat": true, "truncate": true,
+	"remove": true, "removeall": true, "rename": true, "copy": true, "copytree": true,
+}
+
+// fileWrites are the audited operations of files, coalesced into a single write.
+var fileWrites = map[string]bool{"write": true, "writeat": true, "truncate": true}
+
+// WithAudit records every mutating operation, successful or not, in the audit_entries table,
+// along with its actor, see WithActor and ContextWithActor. Operations are recorded in the
+// transaction of their mutation. The successful writes and truncations through a file are
+// recorded as a single write, with the first of them, until the file is synced or closed.
+func WithAudit() Option {
+	return func(f *GormFs) {
+		f.auditEnabled = true
+	}
+}
+
+// WithActor sets the actor recorded in the audit log when the context has none, see ContextWithActor.
+func WithActor(actor string) Option {
+	return func(f *GormFs) {
+		f.actor = actor
+	}
+}
+
+type actorKey struct{}
+
+// ContextWithActor returns a context whose operations, see WithContext, are recorded in the audit
+// log as done by actor.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// AuditFilter selects audit entries, its zero fields matching everything.
+type AuditFilter struct {
+	// PathPrefix matches the entries whose path or new path is PathPrefix or below it.
+	PathPrefix string
+	Actor      string
+	// Since and Until bound the time of the entries, inclusively.
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of entries returned, zero meaning no limit.
+	Limit int
+}
+
+// AuditLog returns the audit entries matching filter, oldest first.
+func (f *GormFs) AuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	query := f.table(&AuditEntry{}).Order("id")
+	if filter.PathPrefix != "" {
+		prefix := filepath.Clean(filter.PathPrefix)
+		below := filepath.Join(prefix, "%")
+		query = query.Where("(path = ? OR path LIKE ? OR new_path = ? OR new_path LIKE ?)", prefix, below, prefix, below)
+	}
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("time >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("time <= ?", filter.Until)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	entries := []AuditEntry{}
+	if err := query.Find(&entries).Error; err != nil {
+		return nil, errors.Wrap(err, "list audit entries")
+	}
+	return entries, nil
+}
+
+// operation is an audited operation, see auditing.
+type operation struct {
+	name string
+	// paths are the path and then the new path if any.
+	paths []string
+	// recorded is set once the operation is in the audit log.
+	recorded bool
+	// quiet operations are recorded only with their mutation or if they fail.
+	quiet bool
+	// coalesced operations are recorded only if they fail, their mutation being already recorded.
+	coalesced bool
+}
+
+// auditing returns a copy of f carrying op on paths as its audited operation,
+// or none if op is not audited, see transaction.
+func (f *GormFs) auditing(op string, paths ...string) *GormFs {
+	g := *f
+	g.op = nil
+	g.outer = f.untraced()
+	if f.auditEnabled && !f.readOnly && auditedOps[op] {
+		g.op = &operation{name: op, paths: paths}
+	}
+	return &g
+}
+
+// auditMutation records the operation of f, successful so far, in the transaction of its mutation.
+func (f *GormFs) auditMutation() error {
+	op := f.op
+	if op == nil || op.recorded || op.coalesced {
+		return nil
+	}
+	if err := f.appendAudit(nil); err != nil {
+		return err
+	}
+	f.afterCommit(func() {
+		op.recorded = true
+	})
+	return nil
+}
+
+// audit records the outcome of the operation of f once it is over, unless it was recorded with its mutation.
+func (f *GormFs) audit(opErr error) error {
+	op := f.op
+	if op == nil || op.recorded || opErr == nil && op.quiet {
+		return nil
+	}
+	if err := f.appendAudit(opErr); err != nil {
+		return err
+	}
+	op.recorded = true
+	return nil
+}
+
+func (f *GormFs) appendAudit(opErr error) error {
+	op := f.op
+	entry := &AuditEntry{Time: f.now(), Actor: f.actor, Op: op.name}
+	if actor, ok := f.context().Value(actorKey{}).(string); ok {
+		entry.Actor = actor
+	}
+	if len(op.paths) > 0 {
+		entry.Path = filepath.Clean(op.paths[0])
+	}
+	if len(op.paths) > 1 {
+		entry.NewPath = filepath.Clean(op.paths[1])
+	}
+	if opErr != nil {
+		entry.Error = opErr.Error()
+	}
+	if err := f.table(&AuditEntry{}).Create(entry).Error; err != nil {
+		return errors.Wrap(err, "append audit entry")
+	}
+	return nil
+}
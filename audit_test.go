@@ -0,0 +1,152 @@
+package gormfs
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func auditOps(entries []AuditEntry) []string {
+	ops := []string{}
+	for _, e := range entries {
+		op := e.Actor + " " + e.Op + " " + e.Path
+		if e.NewPath != "" {
+			op += " " + e.NewPath
+		}
+		if e.Error != "" {
+			op += " failed"
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func TestAudit(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	gfs, err := NewGormFs(testingDB(t), WithAudit(), WithActor("service"), WithClock(clock))
+	require.NoError(t, err)
+
+	require.NoError(t, gfs.Mkdir("/docs", 0755))
+	now = now.Add(time.Hour)
+	alice := gfs.WithContext(ContextWithActor(context.Background(), "alice"))
+	require.NoError(t, afero.WriteFile(alice, "/docs/report", []byte("v1"), 0644))
+	require.NoError(t, alice.Rename("/docs/report", "/archive"))
+	now = now.Add(time.Hour)
+	require.Error(t, alice.Remove("/missing"))
+	require.NoError(t, gfs.Chmod("/archive", 0600))
+	_, err = afero.ReadFile(alice, "/archive")
+	require.NoError(t, err)
+
+	all, err := gfs.AuditLog(AuditFilter{})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"service mkdir /docs",
+		"alice create /docs/report",
+		"alice write /docs/report",
+		"alice rename /docs/report /archive",
+		"alice remove /missing failed",
+		"service chmod /archive",
+	}, auditOps(all))
+	require.True(t, now.Equal(all[len(all)-1].Time))
+
+	entries, err := gfs.AuditLog(AuditFilter{PathPrefix: "/docs"})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"service mkdir /docs",
+		"alice create /docs/report",
+		"alice write /docs/report",
+		"alice rename /docs/report /archive",
+	}, auditOps(entries))
+
+	entries, err = gfs.AuditLog(AuditFilter{PathPrefix: "/archive"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice rename /docs/report /archive", "service chmod /archive"}, auditOps(entries))
+
+	entries, err = gfs.AuditLog(AuditFilter{Actor: "alice", Since: now.Add(-time.Hour), Until: now.Add(-time.Minute)})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"alice create /docs/report",
+		"alice write /docs/report",
+		"alice rename /docs/report /archive",
+	}, auditOps(entries))
+
+	entries, err = gfs.AuditLog(AuditFilter{Actor: "alice", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	plain, err := NewGormFs(gfs.db)
+	require.NoError(t, err)
+	require.NoError(t, plain.Mkdir("/unaudited", 0755))
+	entries, err = gfs.AuditLog(AuditFilter{PathPrefix: "/unaudited"})
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestAuditFileWrites(t *testing.T) {
+	gfs, err := NewGormFs(testingDB(t), WithAudit())
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(gfs, "/file", nil, 0644))
+	require.NoError(t, gfs.SetTreeQuota("/", QuotaLimit{MaxBytes: 8}))
+
+	f, err := gfs.OpenFile("/file", os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("j"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(4))
+	_, err = f.WriteAt([]byte("too long"), 4)
+	require.Error(t, err)
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Truncate(2))
+	require.NoError(t, f.Close())
+
+	f, err = gfs.Open("/file")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("x"))
+	require.Error(t, err)
+	require.NoError(t, f.Close())
+
+	entries, err := gfs.AuditLog(AuditFilter{})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		" create /file",
+		" write /file",
+		" write /file",
+		" write /file failed",
+		" write /file",
+		" write /file failed",
+	}, auditOps(entries))
+}
+
+func TestAuditRollsBack(t *testing.T) {
+	gfs, err := NewGormFs(testingDB(t), WithAudit())
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("content"), 0644))
+	require.NoError(t, gfs.db.Migrator().DropTable(gfs.tableName(&AuditEntry{})))
+
+	// the entries are appended in the transaction of the mutation, which fails with them
+	require.Error(t, gfs.Chmod("/file", 0600))
+	require.Error(t, gfs.Mkdir("/dir", 0755))
+	require.Error(t, gfs.Remove("/file"))
+	f, err := gfs.OpenFile("/file", os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("changed"))
+	require.Error(t, err)
+	require.NoError(t, f.Close())
+
+	info, err := gfs.Stat("/file")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode())
+	exists, err := afero.Exists(gfs, "/dir")
+	require.NoError(t, err)
+	require.False(t, exists)
+	data, err := afero.ReadFile(gfs, "/file")
+	require.NoError(t, err)
+	require.Equal(t, "content", string(data))
+}
@@ -0,0 +1,217 @@
+package gormfs
+
+import (
+	"container/list"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cacheEntryOverhead approximates the memory used by a cache entry besides its name and data.
+const cacheEntryOverhead = 256
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+// WithCache keeps up to maxBytes of recently read entries in memory, evicting the least
+// recently used ones. Local mutations invalidate the cache, changes made by other processes
+// are detected by checking the version of an entry once it has been cached for longer than
+// staleness, zero meaning on every read.
+func WithCache(maxBytes int64, staleness time.Duration) Option {
+	return func(f *GormFs) {
+		f.cache = &cache{
+			maxBytes:  maxBytes,
+			staleness: staleness,
+			lru:       list.New(),
+			entries:   map[string]*list.Element{},
+		}
+	}
+}
+
+// CacheStats returns the statistics of the cache, they are all zero when it is not enabled.
+func (f *GormFs) CacheStats() CacheStats {
+	if f.cache == nil {
+		return CacheStats{}
+	}
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+	stats := f.cache.stats
+	stats.Entries = len(f.cache.entries)
+	stats.Bytes = f.cache.size
+	return stats
+}
+
+type cache struct {
+	maxBytes  int64
+	staleness time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	file    *File
+	size    int64
+	checked time.Time
+}
+
+// loadFile is getFile going through the cache. The returned file must not be modified.
+func (f *GormFs) loadFile(name string) (*File, error) {
+	name = filepath.Clean(name)
+	if f.cache == nil || name == "." || name == "/" { // FIXME: breaks on non-unix
+		return getFile(f.table(&File{}), name, f.now())
+	}
+
+	if file, checked, ok := f.cache.get(name); ok {
+		if file.ExpiresAt != nil && !file.ExpiresAt.After(f.now()) {
+			f.cache.invalidate(name)
+			return nil, &fs.PathError{Op: "get", Path: name, Err: fs.ErrNotExist}
+		}
+		// the entries below an expired directory do not exist either
+		if _, err := f.loadFile(filepath.Dir(name)); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				f.cache.invalidate(name)
+				return nil, &fs.PathError{Op: "get", Path: name, Err: fs.ErrNotExist}
+			}
+			return nil, err
+		}
+		if time.Since(checked) < f.cache.staleness {
+			f.cache.hit()
+			return file, nil
+		}
+		versions := []uint64{}
+		if err := f.table(&File{}).Where("name = ?", name).Limit(1).Pluck("version", &versions).Error; err != nil {
+			return nil, errors.Wrap(err, "check cached version")
+		}
+		if len(versions) > 0 && versions[0] == file.Version {
+			f.cache.touch(name, file)
+			f.cache.hit()
+			return file, nil
+		}
+		f.cache.invalidate(name)
+	}
+
+	f.cache.miss()
+	file, err := getFile(f.table(&File{}), name, f.now())
+	if err != nil {
+		return nil, err
+	}
+	f.cache.put(file)
+	return file, nil
+}
+
+func (c *cache) get(name string) (*File, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[name]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	return entry.file, entry.checked, true
+}
+
+func (c *cache) has(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[name]
+	return ok
+}
+
+// touch marks the cached file as up to date, unless it was replaced meanwhile.
+func (c *cache) touch(name string, file *File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[name]; ok && elem.Value.(*cacheEntry).file == file {
+		elem.Value.(*cacheEntry).checked = time.Now()
+	}
+}
+
+func (c *cache) put(file *File) {
+	size := int64(len(file.Name)+len(file.Data)+len(file.Hash)) + cacheEntryOverhead
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(file.Name)
+	c.entries[file.Name] = c.lru.PushFront(&cacheEntry{file: file, size: size, checked: time.Now()})
+	c.size += size
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry).file.Name)
+		c.stats.Evictions++
+	}
+}
+
+func (c *cache) hit() {
+	c.mu.Lock()
+	c.stats.Hits++
+	c.mu.Unlock()
+}
+
+func (c *cache) miss() {
+	c.mu.Lock()
+	c.stats.Misses++
+	c.mu.Unlock()
+}
+
+func (c *cache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(name)
+}
+
+// invalidateTree drops name and everything below it.
+func (c *cache) invalidateTree(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := strings.TrimSuffix(name, "/") + "/" // FIXME: breaks on non-unix
+	for n := range c.entries {
+		if name == "." || n == name || strings.HasPrefix(n, prefix) {
+			c.remove(n)
+		}
+	}
+}
+
+func (c *cache) remove(name string) {
+	elem, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, name)
+	c.size -= elem.Value.(*cacheEntry).size
+}
+
+// invalidateCache drops the cached entries touched by a mutation, once it is committed.
+func (f *GormFs) invalidateCache(entry JournalEntry) {
+	if f.cache == nil {
+		return
+	}
+	c := f.cache
+	f.afterCommit(func() {
+		switch entry.Op {
+		case JournalRename, JournalRemoveAll, JournalCopy:
+			c.invalidateTree(entry.Name)
+			if entry.NewName != "" {
+				c.invalidateTree(entry.NewName)
+			}
+		default:
+			c.invalidate(entry.Name)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package gormfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheHitsAndInvalidation(t *testing.T) {
+	gfs := TestingFs(t, WithCache(1<<20, time.Hour))
+	require.NoError(t, afero.WriteFile(gfs, "/config", []byte("v1"), 0644))
+
+	read := func() string {
+		data, err := afero.ReadFile(gfs, "/config")
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	require.Equal(t, "v1", read())
+	before := gfs.CacheStats()
+	require.Equal(t, "v1", read())
+	after := gfs.CacheStats()
+	require.Equal(t, before.Misses, after.Misses)
+	require.Greater(t, after.Hits, before.Hits)
+	require.Equal(t, 1, after.Entries)
+
+	require.NoError(t, afero.WriteFile(gfs, "/config", []byte("v2"), 0644))
+	require.Equal(t, "v2", read())
+
+	require.NoError(t, gfs.Rename("/config", "/renamed"))
+	_, err := gfs.Stat("/config")
+	require.Error(t, err)
+	require.NoError(t, gfs.RemoveAll("/renamed"))
+	_, err = gfs.Stat("/renamed")
+	require.Error(t, err)
+}
+
+func TestCacheStaleness(t *testing.T) {
+	writer := TestingFs(t)
+	require.NoError(t, afero.WriteFile(writer, "/config", []byte("v1"), 0644))
+
+	lazy, err := NewGormFs(writer.db, WithCache(1<<20, time.Hour))
+	require.NoError(t, err)
+	strict, err := NewGormFs(writer.db, WithCache(1<<20, 0))
+	require.NoError(t, err)
+
+	for _, fs := range []*GormFs{lazy, strict} {
+		data, err := afero.ReadFile(fs, "/config")
+		require.NoError(t, err)
+		require.Equal(t, "v1", string(data))
+	}
+
+	require.NoError(t, afero.WriteFile(writer, "/config", []byte("v2"), 0644))
+
+	data, err := afero.ReadFile(lazy, "/config")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(data), "within the staleness window")
+	data, err = afero.ReadFile(strict, "/config")
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(data))
+
+	// a recreated file gets a new version
+	require.NoError(t, writer.Remove("/config"))
+	require.NoError(t, afero.WriteFile(writer, "/config", []byte("v3"), 0644))
+	data, err = afero.ReadFile(strict, "/config")
+	require.NoError(t, err)
+	require.Equal(t, "v3", string(data))
+}
+
+func TestCacheEviction(t *testing.T) {
+	gfs := TestingFs(t, WithCache(2*(cacheEntryOverhead+130), time.Hour))
+	for _, name := range []string{"/a", "/b", "/c"} {
+		require.NoError(t, afero.WriteFile(gfs, name, make([]byte, 90), 0644))
+		_, err := afero.ReadFile(gfs, name)
+		require.NoError(t, err)
+	}
+
+	stats := gfs.CacheStats()
+	require.Equal(t, 2, stats.Entries)
+	require.LessOrEqual(t, stats.Bytes, int64(2*(cacheEntryOverhead+130)))
+	require.NotZero(t, stats.Evictions)
+}
@@ -0,0 +1,208 @@
+package gormfs
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type ProblemKind string
+
+const (
+	// ProblemNonCanonicalName is an entry whose name is not clean, see filepath.Clean.
+	ProblemNonCanonicalName ProblemKind = "non-canonical-name"
+	// ProblemOrphan is an entry whose parent directory does not exist.
+	ProblemOrphan ProblemKind = "orphan"
+	// ProblemModeMismatch is an entry whose IsDir disagrees with the directory bit of its Mode.
+	ProblemModeMismatch ProblemKind = "mode-mismatch"
+	// ProblemDanglingContent is a directory holding file content.
+	ProblemDanglingContent ProblemKind = "dangling-content"
+)
+
+type Problem struct {
+	Kind   ProblemKind
+	Path   string
+	Detail string
+	// Repaired is set when the problem was fixed by a repairing Check.
+	Repaired bool
+}
+
+type CheckReport struct {
+	// Checked is the number of entries checked.
+	Checked  int
+	Problems []Problem
+}
+
+// Unrepaired returns the problems that are still present.
+func (r *CheckReport) Unrepaired() []Problem {
+	problems := []Problem{}
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+type checkEntry struct {
+	Name  string
+	Mode  fs.FileMode
+	IsDir bool
+	Size  int64
+}
+
+const checkBatchSize = 1000
+
+// Check looks for inconsistencies left by interrupted operations and, when repair is set, fixes them:
+// non-canonical names are cleaned unless the clean name is taken, missing parent directories are
+// created, IsDir wins over Mode unless a non-directory entry without content has the directory bit,
+// and content held by directories is dropped.
+func (f *GormFs) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	if repair {
+		if err := f.writable("check", "/"); err != nil {
+			return nil, err
+		}
+	}
+	report := &CheckReport{}
+
+	entries, err := f.checkEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]*checkEntry, len(entries))
+	for _, entry := range entries {
+		names[entry.Name] = entry
+	}
+
+	for _, entry := range entries {
+		clean := filepath.Clean(entry.Name)
+		if clean == entry.Name {
+			continue
+		}
+		p := Problem{Kind: ProblemNonCanonicalName, Path: entry.Name, Detail: "should be " + clean}
+		if _, taken := names[clean]; taken {
+			p.Detail += ", which exists"
+		} else if repair {
+			if err := f.table(&File{}).Where("name = ?", entry.Name).Update("name", clean).Error; err != nil {
+				return nil, errors.Wrapf(err, "rename %s", entry.Name)
+			}
+			f.invalidateCache(JournalEntry{Op: JournalRename, Name: entry.Name, NewName: clean})
+			if err := f.invalidateHashes(clean); err != nil {
+				return nil, err
+			}
+			delete(names, entry.Name)
+			entry.Name = clean
+			names[clean] = entry
+			p.Repaired = true
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		report.Checked++
+
+		if entry.IsDir != (entry.Mode&fs.ModeDir != 0) {
+			p := Problem{Kind: ProblemModeMismatch, Path: entry.Name, Detail: "mode " + entry.Mode.String()}
+			if repair {
+				if err := f.repairMode(entry); err != nil {
+					return nil, err
+				}
+				p.Repaired = true
+			}
+			report.Problems = append(report.Problems, p)
+		}
+
+		if entry.IsDir && entry.Size > 0 {
+			p := Problem{Kind: ProblemDanglingContent, Path: entry.Name}
+			if repair {
+				if err := f.table(&File{}).Where("name = ?", entry.Name).
+					Updates(map[string]interface{}{"data": nil, "hash": nil, "version": gorm.Expr("version + 1")}).Error; err != nil {
+					return nil, errors.Wrapf(err, "drop content of %s", entry.Name)
+				}
+				f.invalidateCache(JournalEntry{Op: JournalWrite, Name: entry.Name})
+				p.Repaired = true
+			}
+			report.Problems = append(report.Problems, p)
+		}
+
+		parent := filepath.Dir(entry.Name)
+		if parent == "." || parent == "/" || entry.Name != filepath.Clean(entry.Name) { // FIXME: breaks on non-unix
+			continue
+		}
+		if p, ok := names[parent]; ok && p.IsDir {
+			continue
+		}
+		p := Problem{Kind: ProblemOrphan, Path: entry.Name, Detail: "missing parent " + parent}
+		if blocker := firstNonDir(names, parent); blocker != "" {
+			p.Detail = blocker + " is not a directory"
+		} else if repair {
+			if err := f.MkdirAll(parent, 0755); err != nil {
+				return nil, errors.Wrapf(err, "recreate %s", parent)
+			}
+			for dir := parent; dir != "." && dir != "/"; dir = filepath.Dir(dir) { // FIXME: breaks on non-unix
+				if _, ok := names[dir]; !ok {
+					names[dir] = &checkEntry{Name: dir, Mode: fs.ModeDir | 0755, IsDir: true}
+				}
+			}
+			p.Repaired = true
+		}
+		report.Problems = append(report.Problems, p)
+	}
+	return report, nil
+}
+
+// checkEntries lists every entry without its content, in batches.
+func (f *GormFs) checkEntries(ctx context.Context) ([]*checkEntry, error) {
+	entries := []*checkEntry{}
+	last := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		batch := []*checkEntry{}
+		if err := f.table(&File{}).Select("name, mode, is_dir, COALESCE(LENGTH(data), 0) AS size").
+			Where("name > ?", last).Order("name").Limit(checkBatchSize).Find(&batch).Error; err != nil {
+			return nil, errors.Wrap(err, "list entries")
+		}
+		entries = append(entries, batch...)
+		if len(batch) < checkBatchSize {
+			return entries, nil
+		}
+		last = batch[len(batch)-1].Name
+	}
+}
+
+func (f *GormFs) repairMode(entry *checkEntry) error {
+	if !entry.IsDir && entry.Size == 0 {
+		entry.IsDir = true
+	}
+	mode := entry.Mode &^ fs.ModeDir
+	if entry.IsDir {
+		mode |= fs.ModeDir
+	}
+	if err := f.table(&File{}).Where("name = ?", entry.Name).Updates(map[string]interface{}{
+		"is_dir": entry.IsDir, "mode": mode, "version": gorm.Expr("version + 1"),
+	}).Error; err != nil {
+		return errors.Wrapf(err, "repair mode of %s", entry.Name)
+	}
+	entry.Mode = mode
+	f.invalidateCache(JournalEntry{Op: JournalChmod, Name: entry.Name})
+	return nil
+}
+
+// firstNonDir returns the topmost existing ancestor of dir, or dir itself, that is not a directory.
+func firstNonDir(names map[string]*checkEntry, dir string) string {
+	blocker := ""
+	for ; dir != "." && dir != "/"; dir = filepath.Dir(dir) { // FIXME: breaks on non-unix
+		if entry, ok := names[dir]; ok && !entry.IsDir {
+			blocker = dir
+		}
+	}
+	return blocker
+}
@@ -0,0 +1,76 @@
+package gormfs
+
+import (
+	"context"
+	"io/fs"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func problemKinds(report *CheckReport) []string {
+	kinds := []string{}
+	for _, p := range report.Problems {
+		kinds = append(kinds, string(p.Kind)+" "+p.Path)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func TestCheck(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.MkdirAll("/ok/dir", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/ok/file", []byte("ok"), 0644))
+
+	require.NoError(t, gfs.table(&File{}).Create(&File{Name: "/lost/deep/orphan", Data: []byte("orphan")}).Error)
+	require.NoError(t, gfs.table(&File{}).Create(&File{Name: "/ok//unclean", Data: []byte("unclean")}).Error)
+	require.NoError(t, gfs.table(&File{}).Create(&File{Name: "/notdir", Mode: fs.ModeDir | 0755}).Error)
+	require.NoError(t, gfs.table(&File{}).Create(&File{Name: "/nomode", IsDir: true, Mode: 0755}).Error)
+	require.NoError(t, gfs.table(&File{}).Create(&File{Name: "/fat", IsDir: true, Mode: fs.ModeDir | 0755, Data: []byte("x")}).Error)
+	require.NoError(t, afero.WriteFile(gfs, "/blocker", nil, 0644))
+	require.NoError(t, gfs.table(&File{}).Create(&File{Name: "/blocker/child"}).Error)
+
+	report, err := gfs.Check(context.Background(), false)
+	require.NoError(t, err)
+	require.Equal(t, 10, report.Checked)
+	require.Equal(t, []string{
+		"dangling-content /fat",
+		"mode-mismatch /nomode",
+		"mode-mismatch /notdir",
+		"non-canonical-name /ok//unclean",
+		"orphan /blocker/child",
+		"orphan /lost/deep/orphan",
+	}, problemKinds(report))
+	require.Len(t, report.Unrepaired(), 6)
+
+	report, err = gfs.Check(context.Background(), true)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 6)
+	unrepaired := report.Unrepaired()
+	require.Len(t, unrepaired, 1)
+	require.Equal(t, "/blocker/child", unrepaired[0].Path)
+	require.Equal(t, "/blocker is not a directory", unrepaired[0].Detail)
+
+	data, err := afero.ReadFile(gfs, "/ok/unclean")
+	require.NoError(t, err)
+	require.Equal(t, "unclean", string(data))
+	data, err = afero.ReadFile(gfs, "/lost/deep/orphan")
+	require.NoError(t, err)
+	require.Equal(t, "orphan", string(data))
+	info, err := gfs.Stat("/notdir")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+	require.True(t, info.Mode().IsDir())
+	info, err = gfs.Stat("/nomode")
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsDir())
+	info, err = gfs.Stat("/fat")
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	report, err = gfs.Check(context.Background(), false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orphan /blocker/child"}, problemKinds(report))
+}
@@ -0,0 +1,99 @@
+// Command gormfs inspects and maintains GormFs databases.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/berty/gormfs"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const usage = `usage: gormfs <command> [flags]
+
+commands:
+  check    look for inconsistencies and optionally repair them
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "check":
+		err = check(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gormfs:", err)
+		os.Exit(1)
+	}
+}
+
+// openFs opens the filesystem of a SQLite database.
+func openFs(path, namespace string, opts ...gormfs.Option) (*gormfs.GormFs, error) {
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return nil, err
+	}
+	if namespace != "" {
+		return gormfs.OpenNamespace(db, namespace, opts...)
+	}
+	return gormfs.NewGormFs(db, opts...)
+}
+
+func check(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	dbPath := flags.String("db", "", "path of the SQLite database")
+	namespace := flags.String("namespace", "", "namespace to check, the default one if empty")
+	repair := flags.Bool("repair", false, "fix the problems found")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dbPath == "" {
+		return fmt.Errorf("missing -db")
+	}
+
+	opts := []gormfs.Option{}
+	if !*repair {
+		opts = append(opts, gormfs.WithReadOnly())
+	}
+	fs, err := openFs(*dbPath, *namespace, opts...)
+	if err != nil {
+		return err
+	}
+	report, err := fs.Check(context.Background(), *repair)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Problems {
+		status := ""
+		if p.Repaired {
+			status = " (repaired)"
+		}
+		if p.Detail != "" {
+			fmt.Printf("%s: %s: %s%s\n", p.Kind, p.Path, p.Detail, status)
+		} else {
+			fmt.Printf("%s: %s%s\n", p.Kind, p.Path, status)
+		}
+	}
+	unrepaired := len(report.Unrepaired())
+	fmt.Printf("%d entries checked, %d problems, %d unrepaired\n", report.Checked, len(report.Problems), unrepaired)
+	if unrepaired != 0 {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package gormfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Copy duplicates the regular file src to dst in the database, preserving its metadata.
+func (f *GormFs) Copy(src, dst string) (err error) {
+	f, end := f.begin("copy", src, dst)
+	defer end(&err)
+	return f.copyRows("copy", src, dst, false)
+}
+
+// CopyTree duplicates src and everything below it to dst in the database, preserving metadata.
+// The copy is done in a single transaction.
+func (f *GormFs) CopyTree(src, dst string) (err error) {
+	f, end := f.begin("copytree", src, dst)
+	defer end(&err)
+	return f.copyRows("copytree", src, dst, true)
+}
+
+// copyRows copies src to dst, with everything below it when tree is set, checking the
+// destination and the quotas in the transaction of the copy.
+func (f *GormFs) copyRows(op, src, dst string, tree bool) (err error) {
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+
+	if len(f.hooks) != 0 {
+		// the hooks only run around copies that can be done, checked again in the transaction
+		if err := f.checkCopy(op, src, dst, tree); err != nil {
+			return err
+		}
+	}
+	events, err := f.copyEvents(src, dst, tree)
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		if err := f.before(ev); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		for _, ev := range events {
+			f.after(ev, &err)
+		}
+	}()
+
+	stmt := &gorm.Statement{DB: f.db}
+	if err := stmt.Parse(&File{}); err != nil {
+		return errors.Wrap(err, "parse file schema")
+	}
+	columns := fileColumns(stmt)
+	values := append([]string{}, columns...)
+	args := []interface{}{}
+	for i, name := range stmt.Schema.DBNames {
+		switch name {
+		case "name":
+			values[i] = renameExpr(f.db.Dialector.Name())
+			args = append(args, dst, len(src)+1)
+		case "version":
+			values[i] = "?"
+			args = append(args, uint64(time.Now().UnixNano()))
+		}
+	}
+
+	return f.transaction(func(tx *GormFs) error {
+		now := tx.now()
+		if err := tx.checkCopy(op, src, dst, tree); err != nil {
+			return err
+		}
+		if _, err := tx.removeExpired(dst); err != nil {
+			return err
+		}
+
+		rows := tx.table(&File{}).Where("name = ?", src)
+		if tree {
+			rows = subtree(tx.table(&File{}), src, now)
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) ?", stmt.Quote(clause.Table{Name: tx.tableName(&File{})}), strings.Join(columns, ", "))
+		if err := tx.db.Exec(query, rows.Select(strings.Join(values, ", "), args...)).Error; err != nil {
+			return errors.Wrap(err, "copy files")
+		}
+		if err := tx.checkCopyQuota(op, src, dst); err != nil {
+			return err
+		}
+
+		entry := JournalEntry{Op: JournalCopy, Name: src, NewName: dst}
+		tx.invalidateCache(entry)
+		if err := tx.journal(entry); err != nil {
+			return err
+		}
+		if err := tx.invalidateHashes(dst); err != nil {
+			return err
+		}
+		names := []string{}
+		if err := subtree(tx.table(&File{}), dst, now).Order("name").Pluck("name", &names).Error; err != nil {
+			return errors.Wrap(err, "find copied files")
+		}
+		for _, name := range names {
+			if err := tx.notify(OpCreate, name, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkCopy fails if src cannot be copied to dst.
+func (f *GormFs) checkCopy(op, src, dst string, tree bool) error {
+	file, err := getFile(f.table(&File{}).Omit("data"), src, f.now())
+	if err != nil {
+		return err
+	}
+	if file.IsDir && !tree {
+		return &fs.PathError{Op: op, Path: src, Err: errors.New("is a directory")}
+	}
+	if err := f.writable(op, dst); err != nil {
+		return err
+	}
+	if src == "." || src == "/" || dst == src || strings.HasPrefix(dst, src+"/") { // FIXME: breaks on non-unix
+		return &fs.PathError{Op: op, Path: dst, Err: fs.ErrInvalid}
+	}
+	if f.exists(dst) {
+		return &fs.PathError{Op: op, Path: dst, Err: fs.ErrExist}
+	}
+	if !f.hasParent(dst) {
+		return &fs.PathError{Op: op, Path: dst, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// copyEvents returns the HookCreate events of the files created by copying src to dst.
+func (f *GormFs) copyEvents(src, dst string, tree bool) ([]HookEvent, error) {
+	if len(f.hooks) == 0 {
+		return nil, nil
+	}
+	rows := live(f.table(&File{}), f.now()).Where("name = ?", src)
+	if tree {
+		rows = subtree(f.table(&File{}), src, f.now())
+	}
+	names := []string{}
+	if err := rows.Where("is_dir = ?", false).Order("name").Pluck("name", &names).Error; err != nil {
+		return nil, errors.Wrap(err, "find files to copy")
+	}
+	events := make([]HookEvent, len(names))
+	for i, name := range names {
+		events[i] = HookEvent{Op: HookCreate, Path: dst + strings.TrimPrefix(name, src)}
+	}
+	return events, nil
+}
+
+// fileColumns returns the columns of the files table, quoted for stmt.
+func fileColumns(stmt *gorm.Statement) []string {
+	columns := make([]string, len(stmt.Schema.DBNames))
+	for i, name := range stmt.Schema.DBNames {
+		columns[i] = stmt.Quote(clause.Column{Name: name})
+	}
+	return columns
+}
+
+// renameExpr returns the SQL concatenating its first argument with name from the position
+// given by its second argument.
+func renameExpr(dialect string) string {
+	switch dialect {
+	case "mysql":
+		return "CONCAT(?, SUBSTRING(name, ?))"
+	case "sqlserver":
+		return "? + SUBSTRING(name, ?, LEN(name))"
+	}
+	return "? || substr(name, ?)"
+}
+
+// checkCopyQuota checks the quotas of dst and of the owners of the files below src, once copied.
+func (f *GormFs) checkCopyQuota(op, src, dst string) error {
+	owners := []struct {
+		Owner int
+		Usage
+	}{}
+	user := clause.Column{Name: "user"}
+	if err := subtree(f.table(&File{}), src, f.now()).Where("is_dir = ?", false).
+		Select("? AS owner, COALESCE(SUM(LENGTH(data)), 0) AS bytes, COUNT(*) AS files", user).
+		Clauses(clause.GroupBy{Columns: []clause.Column{user}}).Scan(&owners).Error; err != nil {
+		return errors.Wrap(err, "compute copy size")
+	}
+	total := Usage{}
+	for _, o := range owners {
+		total.Bytes += o.Bytes
+		total.Files += o.Files
+	}
+	if err := f.checkTreeQuota(op, dst, total.Bytes, total.Files, ""); err != nil {
+		return err
+	}
+	for _, o := range owners {
+		if err := f.checkQuota(op, dst, o.Owner, o.Bytes, o.Files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package gormfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopy(t *testing.T) {
+	gfs := TestingFs(t)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, afero.WriteFile(gfs, "/src", []byte("content"), 0640))
+	require.NoError(t, gfs.Chown("/src", 12, 34))
+	require.NoError(t, gfs.Chtimes("/src", mtime, mtime))
+
+	require.NoError(t, gfs.Copy("/src", "/dst"))
+
+	data, err := afero.ReadFile(gfs, "/dst")
+	require.NoError(t, err)
+	require.Equal(t, "content", string(data))
+	src, err := getFile(gfs.table(&File{}), "/src", gfs.now())
+	require.NoError(t, err)
+	dst, err := getFile(gfs.table(&File{}), "/dst", gfs.now())
+	require.NoError(t, err)
+	require.Equal(t, src.Mode, dst.Mode)
+	require.Equal(t, 12, dst.User)
+	require.Equal(t, 34, dst.Group)
+	require.True(t, mtime.Equal(dst.MTime))
+	require.Equal(t, src.Hash, dst.Hash)
+	require.NotEqual(t, src.Version, dst.Version)
+
+	// the copy is independent from the source
+	require.NoError(t, afero.WriteFile(gfs, "/dst", []byte("changed"), 0640))
+	data, err = afero.ReadFile(gfs, "/src")
+	require.NoError(t, err)
+	require.Equal(t, "content", string(data))
+
+	require.True(t, errors.Is(gfs.Copy("/src", "/dst"), os.ErrExist))
+	require.True(t, errors.Is(gfs.Copy("/missing", "/other"), os.ErrNotExist))
+	require.True(t, errors.Is(gfs.Copy("/src", "/nodir/dst"), os.ErrNotExist))
+	require.NoError(t, gfs.Mkdir("/dir", 0755))
+	require.Error(t, gfs.Copy("/dir", "/dir2"))
+}
+
+func subtreeContents(t *testing.T, gfs *GormFs, root string) map[string]string {
+	t.Helper()
+
+	tree := map[string]string{}
+	for name, content := range treeContents(t, gfs) {
+		if strings.HasPrefix(name, root+"/") {
+			tree[relativeTo(root, name)] = content
+		}
+	}
+	return tree
+}
+
+func TestCopyTree(t *testing.T) {
+	gfs := TestingFs(t, WithJournal())
+	require.NoError(t, gfs.MkdirAll("/src/sub", 0750))
+	require.NoError(t, afero.WriteFile(gfs, "/src/a", []byte("a"), 0644))
+	require.NoError(t, afero.WriteFile(gfs, "/src/sub/b", []byte("b"), 0600))
+	require.NoError(t, afero.WriteFile(gfs, "/srcfile", []byte("not copied"), 0644))
+
+	w, err := gfs.Watch("/", true)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, gfs.CopyTree("/src", "/dst"))
+	require.Equal(t, subtreeContents(t, gfs, "/src"), subtreeContents(t, gfs, "/dst"))
+	exists, err := afero.Exists(gfs, "/dstfile")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	for _, name := range []string{"/dst", "/dst/a", "/dst/sub", "/dst/sub/b"} {
+		ev := nextEvent(t, w)
+		require.Equal(t, OpCreate, ev.Op)
+		require.Equal(t, name, ev.Name)
+	}
+
+	srcHash, err := gfs.TreeHash("/src")
+	require.NoError(t, err)
+	dstHash, err := gfs.TreeHash("/dst")
+	require.NoError(t, err)
+	require.Equal(t, srcHash, dstHash)
+
+	require.True(t, errors.Is(gfs.CopyTree("/src", "/src/sub/inner"), os.ErrInvalid))
+	require.True(t, errors.Is(gfs.CopyTree("/src", "/dst"), os.ErrExist))
+
+	// the copy is replayed from the journal
+	entries, err := gfs.Journal(0, 1000)
+	require.NoError(t, err)
+	replica := TestingFs(t)
+	require.NoError(t, replica.ApplyJournal(entries))
+	require.Equal(t, treeContents(t, gfs), treeContents(t, replica))
+}
+
+func TestCopyTreeQuota(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.MkdirAll("/src", 0755))
+	require.NoError(t, gfs.MkdirAll("/limited", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/src/a", []byte("12345678"), 0644))
+	require.NoError(t, gfs.SetTreeQuota("/limited", QuotaLimit{MaxBytes: 4}))
+
+	require.True(t, errors.Is(gfs.CopyTree("/src", "/limited/src"), ErrQuotaExceeded))
+	exists, err := afero.Exists(gfs, "/limited/src")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestCopyTreeSkipsExpired(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.MkdirAll("/src/gone", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/src/gone/inner", []byte("inner"), 0644))
+	require.NoError(t, afero.WriteFile(gfs, "/src/expired", []byte("expired"), 0644))
+	require.NoError(t, afero.WriteFile(gfs, "/src/kept", []byte("kept"), 0644))
+	require.NoError(t, gfs.SetUserQuota(0, QuotaLimit{MaxFiles: 4}))
+	expire(t, gfs, "/src/gone")
+	expire(t, gfs, "/src/expired")
+
+	// only the live file counts against the quota
+	require.NoError(t, gfs.CopyTree("/src", "/dst"))
+	require.Equal(t, map[string]string{"kept": "kept"}, subtreeContents(t, gfs, "/dst"))
+}
+
+func TestCopyTreeRollsBack(t *testing.T) {
+	gfs := TestingFs(t, WithJournal())
+	require.NoError(t, gfs.MkdirAll("/src/sub", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/src/sub/file", []byte("data"), 0644))
+	require.NoError(t, gfs.db.Migrator().DropTable(gfs.tableName(&JournalEntry{})))
+
+	require.Error(t, gfs.CopyTree("/src", "/dst"))
+	exists, err := afero.Exists(gfs, "/dst")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestCopyOverExpired(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(gfs, "/src", []byte("new"), 0644))
+	require.NoError(t, gfs.MkdirAll("/dst/old", 0755))
+	expire(t, gfs, "/dst")
+
+	require.NoError(t, gfs.Copy("/src", "/dst"))
+	data, err := afero.ReadFile(gfs, "/dst")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+	_, err = gfs.Stat("/dst/old")
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,115 @@
+package gormfs
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// CreateExpiring creates a file that is hidden once expiresAt is passed, see PurgeExpired.
+func (f *GormFs) CreateExpiring(name string, expiresAt time.Time) (file afero.File, err error) {
+	f, end := f.begin("create", name)
+	defer end(&err)
+	return f.create(name, &expiresAt)
+}
+
+// SetExpiry hides name once expiresAt is passed, a zero time removes the expiry.
+func (f *GormFs) SetExpiry(name string, expiresAt time.Time) (err error) {
+	f, end := f.begin("expire", name)
+	defer end(&err)
+	if err := f.writable("expire", name); err != nil {
+		return err
+	}
+	var expiry *time.Time
+	if !expiresAt.IsZero() {
+		expiry = &expiresAt
+	}
+	_, err = f.updateFile("expire", name, func(file *File) error {
+		file.ExpiresAt = expiry
+		return nil
+	}, func(tx *GormFs, file *File) error {
+		return tx.record(OpChmod, JournalEntry{Op: JournalExpire, Name: file.Name, ExpiresAt: expiry})
+	})
+	return err
+}
+
+// PurgeExpired deletes the expired entries, with everything below them, returning how many
+// expired entries were deleted.
+func (f *GormFs) PurgeExpired(ctx context.Context) (int, error) {
+	if err := f.writable("purge", "/"); err != nil {
+		return 0, err
+	}
+	names := []string{}
+	if err := f.table(&File{}).Where("expires_at <= ?", f.now()).Order("name").Pluck("name", &names).Error; err != nil {
+		return 0, errors.Wrap(err, "find expired files")
+	}
+	purged := 0
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+		deleted, err := f.removeExpired(name)
+		if err != nil {
+			return purged, errors.Wrapf(err, "purge %s", name)
+		}
+		if deleted {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// StartExpirySweeper calls PurgeExpired every interval in a goroutine, until the returned
+// function is called. Errors are passed to onError when not nil.
+func (f *GormFs) StartExpirySweeper(interval time.Duration, onError func(error)) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := f.PurgeExpired(ctx); err != nil && ctx.Err() == nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// removeExpired deletes name, with everything below it, if it expired, so that it can be
+// created again. The entries are already hidden, so they skip the trash, the hooks, the audit
+// log and the journal, replication treating expired entries as removed, see replicaEntries.
+func (f *GormFs) removeExpired(name string) (bool, error) {
+	name = filepath.Clean(name)
+	deleted := false
+	// the purge is not the mutation of the audited operation of f
+	g := *f
+	g.op = nil
+	err := g.transaction(func(tx *GormFs) error {
+		res := tx.table(&File{}).Where("name = ? AND expires_at <= ?", name, f.now()).Delete(&File{})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete expired file")
+		}
+		if deleted = res.RowsAffected != 0; !deleted {
+			return nil
+		}
+		if err := tx.table(&File{}).Where("name LIKE ?", filepath.Join(name, "%")).Delete(&File{}).Error; err != nil { // FIXME: support paths with %
+			return errors.Wrap(err, "delete expired files")
+		}
+		tx.invalidateCache(JournalEntry{Op: JournalRemoveAll, Name: name})
+		return tx.invalidateHashes(name)
+	})
+	return deleted, err
+}
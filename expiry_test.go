@@ -0,0 +1,189 @@
+package gormfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func expire(t *testing.T, gfs *GormFs, name string) {
+	t.Helper()
+	require.NoError(t, gfs.table(&File{}).Where("name = ?", name).Update("expires_at", time.Now().Add(-time.Second)).Error)
+}
+
+func TestExpiryHidesEntries(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.Mkdir("/uploads", 0755))
+
+	f, err := gfs.CreateExpiring("/uploads/staged", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, afero.WriteFile(gfs, "/uploads/kept", []byte("kept"), 0644))
+
+	names, err := afero.ReadDir(gfs, "/uploads")
+	require.NoError(t, err)
+	require.Len(t, names, 2)
+
+	expire(t, gfs, "/uploads/staged")
+
+	_, err = gfs.Stat("/uploads/staged")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = gfs.Open("/uploads/staged")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	names, err = afero.ReadDir(gfs, "/uploads")
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	require.Equal(t, "kept", names[0].Name())
+
+	// an expired name can be reused
+	require.NoError(t, afero.WriteFile(gfs, "/uploads/staged", []byte("new"), 0644))
+	data, err := afero.ReadFile(gfs, "/uploads/staged")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+}
+
+func TestSetExpiry(t *testing.T) {
+	gfs := TestingFs(t, WithJournal())
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("data"), 0644))
+
+	expiresAt := time.Now().Add(time.Hour).Round(time.Second)
+	require.NoError(t, gfs.SetExpiry("/file", expiresAt))
+	file, err := getFile(gfs.table(&File{}), "/file", gfs.now())
+	require.NoError(t, err)
+	require.True(t, expiresAt.Equal(*file.ExpiresAt))
+
+	entries, err := gfs.Journal(0, 100)
+	require.NoError(t, err)
+	replica := TestingFs(t)
+	require.NoError(t, replica.ApplyJournal(entries))
+	file, err = getFile(replica.table(&File{}), "/file", replica.now())
+	require.NoError(t, err)
+	require.True(t, expiresAt.Equal(*file.ExpiresAt))
+
+	require.NoError(t, gfs.SetExpiry("/file", time.Time{}))
+	file, err = getFile(gfs.table(&File{}), "/file", gfs.now())
+	require.NoError(t, err)
+	require.Nil(t, file.ExpiresAt)
+}
+
+func TestPurgeExpired(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.MkdirAll("/tmp/dir", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/tmp/dir/inner", nil, 0644))
+	require.NoError(t, afero.WriteFile(gfs, "/tmp/file", nil, 0644))
+	require.NoError(t, afero.WriteFile(gfs, "/tmp/kept", nil, 0644))
+	expire(t, gfs, "/tmp/dir")
+	expire(t, gfs, "/tmp/file")
+
+	n, err := gfs.PurgeExpired(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, map[string]string{"/tmp": "<dir>", "/tmp/kept": ""}, treeContents(t, gfs))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	expire(t, gfs, "/tmp/kept")
+	_, err = gfs.PurgeExpired(ctx)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestExpirySweeper(t *testing.T) {
+	gfs := TestingFs(t)
+	f, err := gfs.CreateExpiring("/file", time.Now().Add(100*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	stop := gfs.StartExpirySweeper(50*time.Millisecond, func(err error) { t.Error(err) })
+	defer stop()
+
+	require.Eventually(t, func() bool {
+		var count int64
+		require.NoError(t, gfs.table(&File{}).Count(&count).Error)
+		return count == 0
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestExpiredDirectory(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.MkdirAll("/tree/gone/sub", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/tree/gone/sub/file", []byte("gone"), 0644))
+	require.NoError(t, afero.WriteFile(gfs, "/tree/kept", []byte("kept"), 0644))
+	cached, err := NewGormFs(gfs.db, WithCache(1<<20, time.Hour))
+	require.NoError(t, err)
+	_, err = cached.Stat("/tree/gone/sub/file")
+	require.NoError(t, err)
+	expire(t, gfs, "/tree/gone")
+
+	for _, name := range []string{"/tree/gone", "/tree/gone/sub", "/tree/gone/sub/file"} {
+		_, err := gfs.Stat(name)
+		require.True(t, errors.Is(err, os.ErrNotExist), name)
+	}
+	_, err = cached.Stat("/tree/gone/sub/file")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = afero.ReadFile(gfs, "/tree/gone/sub/file")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	usage, err := gfs.TreeUsage("/tree")
+	require.NoError(t, err)
+	require.Equal(t, Usage{Bytes: 4, Files: 1}, usage)
+
+	var buf bytes.Buffer
+	require.NoError(t, gfs.Export(&buf, "/tree", ArchiveTar))
+	imported := TestingFs(t)
+	require.NoError(t, imported.Import(&buf, "/", ArchiveTar))
+	require.Equal(t, map[string]string{"/kept": "kept"}, treeContents(t, imported))
+
+	other := afero.NewMemMapFs()
+	_, err = gfs.Sync("/tree", other, "/work", KeepAll)
+	require.NoError(t, err)
+	exists, err := afero.Exists(other, "/work/gone")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestExpiryClock(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	removes := 0
+	gfs, err := NewGormFs(testingDB(t), WithClock(clock), WithAudit(), WithTrash(), WithJournal(), WithHooks(HookFuncs{BeforeFunc: func(ctx context.Context, ev HookEvent) error {
+		if ev.Op == HookRemove {
+			removes++
+		}
+		return nil
+	}}))
+	require.NoError(t, err)
+
+	f, err := gfs.CreateExpiring("/file", now.Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = gfs.Stat("/file")
+	require.NoError(t, err)
+
+	now = now.Add(2 * time.Hour)
+	_, err = gfs.Stat("/file")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	n, err := gfs.PurgeExpired(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Empty(t, treeContents(t, gfs))
+
+	// purged entries bypass the trash, the hooks, the audit log and the journal
+	require.Zero(t, removes)
+	batches, err := gfs.Trash()
+	require.NoError(t, err)
+	require.Empty(t, batches)
+	entries, err := gfs.AuditLog(AuditFilter{})
+	require.NoError(t, err)
+	require.Equal(t, []string{" create /file"}, auditOps(entries))
+	journal, err := gfs.Journal(0, 100)
+	require.NoError(t, err)
+	require.Len(t, journal, 1)
+	require.Equal(t, JournalCreate, journal[0].Op)
+}
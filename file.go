@@ -6,18 +6,35 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/spf13/afero"
-	"gorm.io/gorm"
 )
 
 // FIXME: handle O_APPEND flag correctly
 
 type aferoFile struct {
-	db   *gorm.DB
+	fs   *GormFs
 	name string
 	flag int
+	// head is the offset of Read, Write and Seek, which must not be called concurrently.
 	head int64
+
+	// mu guards the fields below, which ReadAt and WriteAt may use concurrently.
+	mu sync.Mutex
+	// ahead holds the bytes read ahead from aheadOff, see WithChunkSize.
+	ahead    []byte
+	aheadOff int64
+	// verified is set once the content was checked, see WithVerifyOnRead.
+	verified bool
+	// written is set once the file was modified through the handle, see HookWriteClose.
+	written bool
+	// audited is set once a write through the handle was audited, until Sync or Close.
+	audited bool
+
+	lockMu sync.Mutex
+	owner  string
+	lock   *heldLock
 }
 
 var _ afero.File = (*aferoFile)(nil)
@@ -26,91 +43,132 @@ func (af *aferoFile) WriteString(s string) (int, error) {
 	return af.Write([]byte(s))
 }
 
-func (af *aferoFile) WriteAt(p []byte, off int64) (int, error) {
+func (af *aferoFile) WriteAt(p []byte, off int64) (n int, err error) {
+	g, end := af.begin("writeat")
+	defer end(&err)
+	if err := g.writable("writeat", af.name); err != nil {
+		return 0, err
+	}
 	if af.isReadOnly() {
 		return 0, errors.New("file handle is read only")
 	}
 
-	f, err := getFile(af.db, af.name)
+	n, err = af.writeAt(g, p, off)
 	if err != nil {
 		return 0, err
 	}
-
-	newSize := off + int64(len(p))
-	if int64(len(f.Data)) < newSize {
-		buf := make([]byte, newSize)
-		copy(buf, f.Data)
-		f.Data = buf
-	}
-
-	n := copy(f.Data[off:], p)
-
-	if err := af.db.Save(f).Error; err != nil {
-		return 0, err
-	}
-
+	g.transfer(0, n)
+	af.markWritten()
 	return n, nil
 }
 
-func (af *aferoFile) Write(p []byte) (int, error) {
+func (af *aferoFile) Write(p []byte) (n int, err error) {
+	g, end := af.begin("write")
+	defer end(&err)
+	if err := g.writable("write", af.name); err != nil {
+		return 0, err
+	}
 	if af.isReadOnly() {
 		return 0, errors.New("file handle is read only")
 	}
 
-	f, err := getFile(af.db, af.name)
+	off := af.head
+	n, err = af.writeAt(g, p, off)
 	if err != nil {
 		return 0, err
 	}
-
-	newSize := af.head + int64(len(p))
-	if int64(len(f.Data)) < newSize {
-		buf := make([]byte, newSize)
-		copy(buf, f.Data)
-		f.Data = buf
-	}
-
-	n := copy(f.Data[af.head:], p)
-
-	if err := af.db.Save(f).Error; err != nil {
-		return 0, err
-	}
-
+	g.transfer(0, n)
+	af.markWritten()
 	af.head += int64(n)
-
 	return n, nil
 }
 
-func (af *aferoFile) Truncate(size int64) error {
+// writeAt writes p at off in the file of af with g, the filesystem of the calling operation.
+func (af *aferoFile) writeAt(g *GormFs, p []byte, off int64) (int, error) {
+	af.dropReadAhead()
+	n := 0
+	var grown int64
+	_, err := g.updateFile("write", af.name, func(f *File) error {
+		newSize := off + int64(len(p))
+		grown = newSize - int64(len(f.Data))
+		if int64(len(f.Data)) < newSize {
+			buf := make([]byte, newSize)
+			copy(buf, f.Data)
+			f.Data = buf
+		}
+
+		n = copy(f.Data[off:], p)
+		f.MTime = g.now()
+		f.Hash = contentHash(f.Data)
+		return nil
+	}, func(tx *GormFs, f *File) error {
+		if err := tx.checkQuota("write", af.name, f.User, grown, 0); err != nil {
+			return err
+		}
+		return tx.record(OpWrite, JournalEntry{Op: JournalWrite, Name: af.name, Offset: off, Data: p[:n]})
+	})
+	return n, err
+}
+
+func (af *aferoFile) Truncate(size int64) (err error) {
+	g, end := af.begin("truncate")
+	defer end(&err)
+	if err := g.writable("truncate", af.name); err != nil {
+		return err
+	}
 	if af.isReadOnly() {
 		return errors.New("file handle is read only")
 	}
 
-	f, err := getFile(af.db, af.name)
-	if err != nil {
-		return err
-	}
+	af.dropReadAhead()
+	var grown int64
+	_, err = g.updateFile("truncate", af.name, func(f *File) error {
+		if int64(len(f.Data)) == size {
+			return errUnchanged
+		}
 
-	if int64(len(f.Data)) == size {
+		grown = size - int64(len(f.Data))
+		if int64(len(f.Data)) > size {
+			f.Data = f.Data[:size]
+		} else {
+			buf := make([]byte, size)
+			copy(buf, f.Data)
+			f.Data = buf
+		}
+		f.MTime = g.now()
+		f.Hash = contentHash(f.Data)
+		return nil
+	}, func(tx *GormFs, f *File) error {
+		if err := tx.checkQuota("truncate", af.name, f.User, grown, 0); err != nil {
+			return err
+		}
+		return tx.record(OpWrite, JournalEntry{Op: JournalTruncate, Name: af.name, Size: size})
+	})
+	if err == errUnchanged {
 		return nil
 	}
-
-	if int64(len(f.Data)) > size {
-		f.Data = f.Data[:size]
-	} else {
-		buf := make([]byte, size)
-		copy(buf, f.Data)
-		f.Data = buf
+	if err != nil {
+		return err
 	}
-
-	return af.db.Save(f).Error
+	af.markWritten()
+	return nil
 }
 
 func (af *aferoFile) Sync() error {
+	af.mu.Lock()
+	af.audited = false
+	af.mu.Unlock()
 	return nil
 }
 
-func (af *aferoFile) Stat() (fs.FileInfo, error) {
-	f, err := getFile(af.db, af.name)
+func (af *aferoFile) Stat() (info fs.FileInfo, err error) {
+	g, end := af.begin("stat")
+	defer end(&err)
+	return af.stat(g)
+}
+
+func (af *aferoFile) stat(g *GormFs) (fs.FileInfo, error) {
+	f, err := g.loadFile(af.name)
 	if err != nil {
 		return nil, err
 	}
@@ -124,7 +182,7 @@ func (af *aferoFile) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		af.head += offset
 	case io.SeekEnd:
-		f, err := af.Stat()
+		f, err := af.stat(af.fs)
 		if err != nil {
 			return af.head, err
 		}
@@ -145,52 +203,84 @@ func (af *aferoFile) Readdirnames(count int) ([]string, error) {
 	return names, nil
 }
 
-func (af *aferoFile) Readdir(count int) ([]fs.FileInfo, error) {
+func (af *aferoFile) Readdir(count int) (infos []fs.FileInfo, err error) {
+	g, end := af.begin("readdir")
+	defer end(&err)
 	files := []*File{}
-	if err := af.db.
-		Where("name LIKE ?", filepath.Join(af.name, "%")).
-		Not("name LIKE ?", filepath.Join(af.name, "%", "%")).Find(&files).
-		Error; err != nil {
+	if err := childrenOf(g.table(&File{}), af.name, g.now()).Find(&files).Error; err != nil {
 		return nil, err
 	}
-	infos := make([]fs.FileInfo, len(files))
+	infos = make([]fs.FileInfo, len(files))
 	for i, f := range files {
 		infos[i] = &fileInfo{f}
 	}
 	return infos, nil
 }
 
-func (af *aferoFile) ReadAt(p []byte, off int64) (int, error) {
-	f, err := getFile(af.db, af.name)
+func (af *aferoFile) ReadAt(p []byte, off int64) (n int, err error) {
+	g, end := af.begin("readat")
+	defer end(&err)
+	if off < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: af.name, Err: errors.New("negative offset")}
+	}
+	if err := af.verify(g); err != nil {
+		return 0, err
+	}
+	chunk, size, err := g.readRange(af.name, off, len(p))
 	if err != nil {
 		return 0, err
 	}
 
-	if off == int64(len(f.Data)) {
+	if off == size {
 		return 0, io.EOF
 	}
-	if off > int64(len(f.Data)) {
+	if off > size {
 		return 0, io.ErrUnexpectedEOF
 	}
 
-	return copy(p, f.Data[off:]), nil
+	n = copy(p, chunk)
+	g.transfer(n, 0)
+	return n, nil
 }
 
-func (af *aferoFile) Read(p []byte) (int, error) {
-	f, err := getFile(af.db, af.name)
+func (af *aferoFile) Read(p []byte) (n int, err error) {
+	g, end := af.begin("read")
+	defer end(&err)
+	if err := af.verify(g); err != nil {
+		return 0, err
+	}
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	if af.head >= af.aheadOff && af.head < af.aheadOff+int64(len(af.ahead)) {
+		n = copy(p, af.ahead[af.head-af.aheadOff:])
+		af.head += int64(n)
+		g.transfer(n, 0)
+		return n, nil
+	}
+	af.ahead = nil
+
+	want := len(p)
+	if want < g.readAhead {
+		want = g.readAhead
+	}
+	chunk, size, err := g.readRange(af.name, af.head, want)
 	if err != nil {
 		return 0, err
 	}
 
-	if af.head == int64(len(f.Data)) {
+	if af.head == size {
 		return 0, io.EOF
 	}
-	if af.head > int64(len(f.Data)) {
+	if af.head > size {
 		return 0, io.ErrUnexpectedEOF
 	}
 
-	n := copy(p, f.Data[af.head:])
+	n = copy(p, chunk)
+	if n < len(chunk) {
+		af.ahead, af.aheadOff = chunk, af.head
+	}
 	af.head += int64(n)
+	g.transfer(n, 0)
 	return n, nil
 }
 
@@ -198,15 +288,36 @@ func (af *aferoFile) Name() string {
 	return af.name
 }
 
-func (af *aferoFile) Close() error {
-	return nil
+func (af *aferoFile) Close() (err error) {
+	g, end := af.begin("close")
+	defer end(&err)
+	af.mu.Lock()
+	written := af.written
+	af.written = false
+	af.audited = false
+	af.mu.Unlock()
+	if written {
+		ev := HookEvent{Op: HookWriteClose, Path: af.name}
+		if err = g.before(ev); err == nil {
+			defer g.after(ev, &err)
+		}
+	}
+
+	af.lockMu.Lock()
+	defer af.lockMu.Unlock()
+	if af.lock != nil {
+		if lockErr := af.releaseLock(); err == nil {
+			err = lockErr
+		}
+	}
+	return err
 }
 
-func newAferoFile(db *gorm.DB, name string, flag int) (*aferoFile, error) {
+func newAferoFile(fs *GormFs, name string, flag int) (*aferoFile, error) {
 	name = filepath.Clean(name)
-	file := &aferoFile{name: name, db: db, flag: flag}
+	file := &aferoFile{name: name, fs: fs.untraced(), flag: flag}
 	if flag&os.O_APPEND != 0 {
-		s, err := file.Stat()
+		s, err := file.stat(fs)
 		if err != nil {
 			return nil, err
 		}
@@ -215,6 +326,19 @@ func newAferoFile(db *gorm.DB, name string, flag int) (*aferoFile, error) {
 	return file, nil
 }
 
+// dropReadAhead forgets the bytes read ahead, before they are overwritten.
+func (af *aferoFile) dropReadAhead() {
+	af.mu.Lock()
+	af.ahead = nil
+	af.mu.Unlock()
+}
+
+func (af *aferoFile) markWritten() {
+	af.mu.Lock()
+	af.written = true
+	af.mu.Unlock()
+}
+
 func (af *aferoFile) isReadOnly() bool {
-	return af.flag&os.O_RDONLY != 0
+	return af.flag&(os.O_WRONLY|os.O_RDWR) == 0
 }
@@ -29,7 +29,15 @@ func (fi *fileInfo) IsDir() bool {
 	return fi.File.IsDir
 }
 
-func (fi *fileInfo) Sys() interface{} { return nil }
+// Sys returns fi, which implements Checksummed.
+func (fi *fileInfo) Sys() interface{} { return fi }
+
+func (fi *fileInfo) Checksum() []byte {
+	if fi.File.IsDir {
+		return nil
+	}
+	return fi.File.Hash
+}
 
 func (fi *fileInfo) Size() int64 {
 	return int64(len(fi.File.Data))
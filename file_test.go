@@ -1,11 +1,18 @@
 package gormfs
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
 )
 
 func TestReaddirnames(t *testing.T) {
@@ -32,3 +39,136 @@ func TestReaddirnames(t *testing.T) {
 
 	require.Equal(t, append([]string{"d"}, names...), readNames)
 }
+
+func TestConcurrentWriteAt(t *testing.T) {
+	fs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(fs, "/file", make([]byte, 64), 0644))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := fs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Close()
+			_, err = f.WriteAt(bytes.Repeat([]byte{byte('a' + i)}, 8), int64(i*8))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	data, err := afero.ReadFile(fs, "/file")
+	require.NoError(t, err)
+	require.Equal(t, "aaaaaaaabbbbbbbbccccccccddddddddeeeeeeeeffffffffgggggggghhhhhhhh", string(data))
+}
+
+func TestUpdateConflict(t *testing.T) {
+	fs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(fs, "/file", []byte("data"), 0644))
+
+	file, err := getFile(fs.table(&File{}), "/file", fs.now())
+	require.NoError(t, err)
+	initial := file.Version
+
+	// every attempt races with an update saved in between
+	_, err = fs.updateFile("write", "/file", func(f *File) error {
+		return fs.table(&File{}).Where("name = ?", f.Name).Update("version", f.Version+1).Error
+	}, nil)
+	require.True(t, errors.Is(err, ErrConflict))
+
+	file, err = getFile(fs.table(&File{}), "/file", fs.now())
+	require.NoError(t, err)
+	require.Equal(t, initial+maxUpdateAttempts, file.Version)
+}
+
+func TestRenameConflict(t *testing.T) {
+	fs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(fs, "/file", []byte("old"), 0644))
+
+	// a write is saved between the read of the renamed files and their move
+	raced := false
+	require.NoError(t, fs.db.Callback().Query().After("gorm:query").Register("test:race", func(tx *gorm.DB) {
+		if !raced && strings.Contains(tx.Statement.SQL.String(), "LIKE") {
+			raced = true
+			require.NoError(t, fs.table(&File{}).Where("name = ?", "/file").
+				Updates(map[string]interface{}{"data": []byte("new"), "version": gorm.Expr("version + 1")}).Error)
+		}
+	}))
+	require.NoError(t, fs.Rename("/file", "/renamed"))
+	require.True(t, raced)
+
+	data, err := afero.ReadFile(fs, "/renamed")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+}
+
+func TestReadRange(t *testing.T) {
+	fs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(fs, "/file", []byte("0123456789"), 0644))
+
+	f, err := fs.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := make([]byte, 4)
+	n, err := f.ReadAt(buf, 3)
+	require.NoError(t, err)
+	require.Equal(t, "3456", string(buf[:n]))
+	n, err = f.ReadAt(buf, 8)
+	require.NoError(t, err)
+	require.Equal(t, "89", string(buf[:n]))
+	_, err = f.ReadAt(buf, 10)
+	require.Equal(t, io.EOF, err)
+
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "0123456789", string(data))
+}
+
+func TestReadAhead(t *testing.T) {
+	fs := TestingFs(t, WithChunkSize(64))
+	content := bytes.Repeat([]byte("0123456789abcdef"), 16)
+	require.NoError(t, afero.WriteFile(fs, "/file", content, 0644))
+
+	queries := 0
+	require.NoError(t, fs.db.Callback().Query().After("gorm:query").Register("test:count", func(*gorm.DB) { queries++ }))
+
+	f, err := fs.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+	queries = 0
+
+	data := []byte{}
+	buf := make([]byte, 8)
+	for {
+		n, err := f.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	require.Equal(t, content, data)
+	require.Equal(t, len(content)/64+1, queries)
+
+	// writes through the handle drop the read-ahead buffer
+	rw, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer rw.Close()
+	_, err = rw.Read(buf)
+	require.NoError(t, err)
+	_, err = rw.WriteAt([]byte("XXXXXXXX"), 8)
+	require.NoError(t, err)
+	_, err = rw.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "XXXXXXXX", string(buf))
+}
@@ -1,6 +1,7 @@
 package gormfs
 
 import (
+	"context"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -9,72 +10,174 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
+// ErrConflict is returned when an update kept racing with concurrent updates of the same file.
+var ErrConflict = errors.New("concurrent update conflict")
+
+const maxUpdateAttempts = 10
+
 // FIXME: set File.Mode, File.ATime, File.User and File.Group correctly
 // FIXME: handle flag correctly
 
 type GormFs struct {
-	db *gorm.DB
+	db             *gorm.DB
+	changeLog      bool
+	journalEnabled bool
+	trashEnabled   bool
+	verifyOnRead   bool
+	readOnly       bool
+	auditEnabled   bool
+	// actor is recorded in the audit log when the context has none.
+	actor  string
+	origin string
+	// namespace prefixes the table names, it is empty for the default namespace.
+	namespace string
+	schema    SchemaOptions
+	migration MigrationMode
+	lockLease time.Duration
+	cache     *cache
+	readAhead int
+	umask     fs.FileMode
+	uid, gid  int
+	clock     func() time.Time
+
+	hooks           []Hooks
+	instrumentation Instrumentation
+	tracer          trace.Tracer
+	// ctx is the context of the operations, see WithContext.
+	ctx context.Context
+	// span is the span of the current operation and outer the filesystem it was started on, see begin.
+	span  trace.Span
+	outer *GormFs
+	// op is the audited operation of the filesystem, see auditing.
+	op *operation
+	// tx is set on the filesystems whose queries are part of a transaction, see transaction.
+	tx *txState
 }
 
-func NewGormFs(db *gorm.DB) (*GormFs, error) {
-	if err := db.AutoMigrate(allModels...); err != nil {
-		return nil, errors.Wrap(err, "migrate db")
+// NewGormFs returns a filesystem stored in db, migrating its schema unless opts say otherwise.
+func NewGormFs(db *gorm.DB, opts ...Option) (*GormFs, error) {
+	f := &GormFs{db: db}
+	f.applyOptions(opts)
+	if err := f.prepareSchema(); err != nil {
+		return nil, err
 	}
-	return &GormFs{db: db}, nil
+	return f, nil
 }
 
 var _ afero.Fs = (*GormFs)(nil)
 
-func (f *GormFs) Chmod(name string, mode fs.FileMode) error {
-	file, err := getFile(f.db, name)
-	if err != nil {
+func (f *GormFs) Chmod(name string, mode fs.FileMode) (err error) {
+	f, end := f.begin("chmod", name)
+	defer end(&err)
+	if err := f.writable("chmod", name); err != nil {
 		return err
 	}
-	isDir := file.Mode&fs.ModeDir != 0
-	file.Mode = mode
-	if isDir {
-		file.Mode |= fs.ModeDir
+	if !f.exists(name) {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	ev := HookEvent{Op: HookChmod, Path: name, Mode: mode}
+	if err := f.before(ev); err != nil {
+		return err
 	}
-	file.MTime = time.Now()
-	return f.db.Save(file).Error
+	defer f.after(ev, &err)
+	_, err = f.updateFile("chmod", name, func(file *File) error {
+		isDir := file.Mode&fs.ModeDir != 0
+		file.Mode = mode
+		if isDir {
+			file.Mode |= fs.ModeDir
+		}
+		file.MTime = f.now()
+		return nil
+	}, func(tx *GormFs, file *File) error {
+		return tx.record(OpChmod, JournalEntry{Op: JournalChmod, Name: file.Name, Mode: file.Mode})
+	})
+	return err
 }
 
-func (f *GormFs) Chown(name string, uid, gid int) error {
-	file, err := getFile(f.db, name)
-	if err != nil {
+func (f *GormFs) Chown(name string, uid, gid int) (err error) {
+	f, end := f.begin("chown", name)
+	defer end(&err)
+	if err := f.writable("chown", name); err != nil {
 		return err
 	}
-	file.User = uid
-	file.Group = gid
-	file.MTime = time.Now()
-	return f.db.Save(file).Error
+	_, err = f.updateFile("chown", name, func(file *File) error {
+		file.User = uid
+		file.Group = gid
+		file.MTime = f.now()
+		return nil
+	}, func(tx *GormFs, file *File) error {
+		return tx.record(OpChmod, JournalEntry{Op: JournalChown, Name: file.Name, User: uid, Group: gid})
+	})
+	return err
 }
 
-func (f *GormFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	file, err := getFile(f.db, name)
-	if err != nil {
+func (f *GormFs) Chtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	f, end := f.begin("chtimes", name)
+	defer end(&err)
+	if err := f.writable("chtimes", name); err != nil {
 		return err
 	}
-	file.ATime = atime
-	file.MTime = mtime
-	return f.db.Save(file).Error
+	_, err = f.updateFile("chtimes", name, func(file *File) error {
+		file.ATime = atime
+		file.MTime = mtime
+		return nil
+	}, func(tx *GormFs, file *File) error {
+		return tx.record(OpChmod, JournalEntry{Op: JournalChtimes, Name: file.Name, ATime: atime, MTime: mtime})
+	})
+	return err
+}
+
+func (f *GormFs) Create(name string) (file afero.File, err error) {
+	f, end := f.begin("create", name)
+	defer end(&err)
+	return f.create(name, nil)
 }
 
-func (f *GormFs) Create(name string) (afero.File, error) {
+func (f *GormFs) create(name string, expiresAt *time.Time) (file afero.File, err error) {
+	if err := f.writable("create", name); err != nil {
+		return nil, err
+	}
+	ev := HookEvent{Op: HookCreate, Path: name}
+	if err := f.before(ev); err != nil {
+		return nil, err
+	}
+	defer f.after(ev, &err)
 	if !f.hasParent(name) {
 		return nil, &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrNotExist}
 	}
-	now := time.Now()
-	if err := f.db.Create(&File{Name: filepath.Clean(name), ATime: now, MTime: now}).Error; err != nil {
-		return nil, errors.Wrap(err, "create db file")
+	if _, err := f.removeExpired(name); err != nil {
+		return nil, err
+	}
+	now := f.now()
+	err = f.transaction(func(tx *GormFs) error {
+		if err := tx.table(&File{}).Create(&File{Name: filepath.Clean(name), ATime: now, MTime: now, User: f.uid, Group: f.gid, ExpiresAt: expiresAt}).Error; err != nil {
+			return errors.Wrap(err, "create db file")
+		}
+		if err := tx.checkQuota("create", name, f.uid, 0, 1); err != nil {
+			return err
+		}
+		return tx.record(OpCreate, JournalEntry{Op: JournalCreate, Name: filepath.Clean(name), ExpiresAt: expiresAt})
+	})
+	if err != nil {
+		return nil, err
 	}
-	return f.OpenFile(name, os.O_RDWR, os.ModePerm)
+	return f.openFile(name, os.O_RDWR, os.ModePerm)
 }
 
-func (f *GormFs) Mkdir(name string, perm fs.FileMode) error {
+func (f *GormFs) Mkdir(name string, perm fs.FileMode) (err error) {
+	f, end := f.begin("mkdir", name)
+	defer end(&err)
+	return f.mkdir(name, perm)
+}
+
+func (f *GormFs) mkdir(name string, perm fs.FileMode) error {
+	if err := f.writable("mkdir", name); err != nil {
+		return err
+	}
 	name = filepath.Clean(name)
 	if f.exists(name) {
 		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
@@ -82,13 +185,24 @@ func (f *GormFs) Mkdir(name string, perm fs.FileMode) error {
 	if !f.hasParent(name) {
 		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrNotExist}
 	}
-	if err := f.db.Create(&File{Name: name, IsDir: true, Mode: perm | fs.ModeDir}).Error; err != nil {
+	if _, err := f.removeExpired(name); err != nil {
 		return err
 	}
-	return nil
+	mode := perm&^f.umask | fs.ModeDir
+	return f.transaction(func(tx *GormFs) error {
+		if err := tx.table(&File{}).Create(&File{Name: name, IsDir: true, Mode: mode, User: f.uid, Group: f.gid}).Error; err != nil {
+			return err
+		}
+		return tx.record(OpCreate, JournalEntry{Op: JournalMkdir, Name: name, Mode: mode})
+	})
 }
 
-func (f *GormFs) MkdirAll(path string, perm fs.FileMode) error {
+func (f *GormFs) MkdirAll(path string, perm fs.FileMode) (err error) {
+	f, end := f.begin("mkdirall", path)
+	defer end(&err)
+	if err := f.writable("mkdir", path); err != nil {
+		return err
+	}
 	path = filepath.Clean(path)
 	paths := strings.Split(path, "/") // FIXME: breaks on non-unix
 	if len(paths) > 0 && paths[0] == "" {
@@ -99,7 +213,7 @@ func (f *GormFs) MkdirAll(path string, perm fs.FileMode) error {
 		if f.exists(name) {
 			continue
 		}
-		if err := f.Mkdir(name, perm); err != nil && !os.IsExist(err) {
+		if err := f.mkdir(name, perm); err != nil && !os.IsExist(err) {
 			return err
 		}
 	}
@@ -110,12 +224,25 @@ func (f *GormFs) Name() string {
 	return "GormFs"
 }
 
-func (f *GormFs) Open(name string) (afero.File, error) {
-	return f.OpenFile(name, os.O_RDONLY, 0)
+func (f *GormFs) Open(name string) (file afero.File, err error) {
+	f, end := f.begin("open", name)
+	defer end(&err)
+	return f.openFile(name, os.O_RDONLY, 0)
+}
+
+func (f *GormFs) OpenFile(name string, flag int, perm fs.FileMode) (file afero.File, err error) {
+	f, end := f.begin("openfile", name)
+	defer end(&err)
+	return f.openFile(name, flag, perm)
 }
 
-func (f *GormFs) OpenFile(name string, flag int, perm fs.FileMode) (afero.File, error) {
+func (f *GormFs) openFile(name string, flag int, perm fs.FileMode) (afero.File, error) {
 	name = filepath.Clean(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := f.writable("openf", name); err != nil {
+			return nil, err
+		}
+	}
 	if f.exists(name) {
 		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
 			return nil, &fs.PathError{Op: "openf", Path: name, Err: fs.ErrExist}
@@ -124,70 +251,203 @@ func (f *GormFs) OpenFile(name string, flag int, perm fs.FileMode) (afero.File,
 		if flag&os.O_CREATE == 0 {
 			return nil, &fs.PathError{Op: "openf", Path: name, Err: fs.ErrNotExist}
 		}
-		if err := f.db.Create(&File{Name: filepath.Clean(name), Mode: perm}).Error; err != nil {
+		c := f.auditing("create", name)
+		ev := HookEvent{Op: HookCreate, Path: name}
+		err := c.before(ev)
+		if err == nil {
+			err = c.createFile(name, perm)
+			c.after(ev, &err)
+		}
+		if auditErr := c.audit(err); err == nil {
+			err = auditErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	file, err := newAferoFile(f, name, flag)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := file.Truncate(0); err != nil {
 			return nil, err
 		}
 	}
-	return newAferoFile(f.db, name, flag)
+	return file, nil
 }
 
-func (f *GormFs) Remove(name string) error {
+// createFile creates the missing file name for OpenFile.
+func (f *GormFs) createFile(name string, perm fs.FileMode) error {
+	if _, err := f.removeExpired(name); err != nil {
+		return err
+	}
+	mode := perm &^ f.umask
+	return f.transaction(func(tx *GormFs) error {
+		if err := tx.table(&File{}).Create(&File{Name: name, Mode: mode, User: f.uid, Group: f.gid}).Error; err != nil {
+			return err
+		}
+		if err := tx.checkQuota("openf", name, f.uid, 0, 1); err != nil {
+			return err
+		}
+		return tx.record(OpCreate, JournalEntry{Op: JournalCreate, Name: name, Mode: mode})
+	})
+}
+
+func (f *GormFs) Remove(name string) (err error) {
+	f, end := f.begin("remove", name)
+	defer end(&err)
+	if err := f.writable("remove", name); err != nil {
+		return err
+	}
 	name = filepath.Clean(name)
 	if !f.exists(name) {
 		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
 	}
-	return f.db.Delete(&File{Name: name}).Error
+	ev := HookEvent{Op: HookRemove, Path: name}
+	if err := f.before(ev); err != nil {
+		return err
+	}
+	defer f.after(ev, &err)
+	return retryStale("remove", name, func() error {
+		file, err := getFile(f.table(&File{}).Select("name", "version"), name, f.now())
+		if err != nil {
+			return err
+		}
+		return f.transaction(func(tx *GormFs) error {
+			if err := tx.claimFiles([]*File{file}); err != nil {
+				return err
+			}
+			if err := tx.deleteFiles(name, false); err != nil {
+				return err
+			}
+			return tx.record(OpRemove, JournalEntry{Op: JournalRemove, Name: name})
+		})
+	})
 }
 
-func (f *GormFs) RemoveAll(path string) error {
+func (f *GormFs) RemoveAll(path string) (err error) {
+	f, end := f.begin("removeall", path)
+	defer end(&err)
+	if err := f.writable("removeall", path); err != nil {
+		return err
+	}
 	path = filepath.Clean(path)
-	return f.db.
-		Where("name LIKE ?", filepath.Join(path, "%")).Or("name = ? AND is_dir = true", path). // FIXME: support paths with %
-		Delete(&File{}).Error
+	if !f.exists(path) {
+		return nil
+	}
+	ev := HookEvent{Op: HookRemove, Path: path}
+	if err := f.before(ev); err != nil {
+		return err
+	}
+	defer f.after(ev, &err)
+	return retryStale("removeall", path, func() error {
+		files := []*File{}
+		if err := descendants(f.table(&File{}), path, f.now()).Or("name = ?", path).Order("name DESC").Select("name", "version").Find(&files).Error; err != nil {
+			return errors.Wrap(err, "find files")
+		}
+		if len(files) == 0 {
+			return nil
+		}
+		return f.transaction(func(tx *GormFs) error {
+			if err := tx.claimFiles(files); err != nil {
+				return err
+			}
+			if err := tx.deleteFiles(path, true); err != nil {
+				return err
+			}
+			entry := JournalEntry{Op: JournalRemoveAll, Name: path}
+			tx.invalidateCache(entry)
+			if err := tx.journal(entry); err != nil {
+				return err
+			}
+			if err := tx.invalidateHashes(path); err != nil {
+				return err
+			}
+			for _, file := range files {
+				if err := tx.notify(OpRemove, file.Name, ""); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
 }
 
-func (f *GormFs) Rename(oldname, newname string) error {
+func (f *GormFs) Rename(oldname, newname string) (err error) {
+	f, end := f.begin("rename", oldname, newname)
+	defer end(&err)
+	if err := f.writable("rename", oldname); err != nil {
+		return err
+	}
 	oldname = filepath.Clean(oldname)
 	newname = filepath.Clean(newname)
-
 	if !f.exists(oldname) {
 		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist} // FIXME: error parity with os
 	}
-
-	oldFiles := []*File{}
-	if err := f.db.Where("name LIKE ?", filepath.Join(oldname, "%")).Or("name = ?", oldname).Find(&oldFiles).Error; err != nil {
-		return errors.Wrap(err, "find files")
-	}
-
-	now := time.Now()
-
-	newFiles := make([]*File, len(oldFiles))
-	for i := range oldFiles {
-		f := *oldFiles[i]
-		newFiles[i] = &f
-		fnn := strings.TrimPrefix(oldFiles[i].Name, oldname)
-		newFiles[i].Name = newname + fnn
-		newFiles[i].MTime = now
+	ev := HookEvent{Op: HookRename, Path: oldname, NewPath: newname}
+	if err := f.before(ev); err != nil {
+		return err
 	}
+	defer f.after(ev, &err)
 
-	if err := f.db.Save(newFiles).Error; err != nil {
-		return errors.Wrap(err, "save files")
-	}
+	return retryStale("rename", oldname, func() error {
+		oldFiles := []*File{}
+		if err := f.table(&File{}).Where("name LIKE ?", filepath.Join(oldname, "%")).Or("name = ?", oldname).Find(&oldFiles).Error; err != nil {
+			return errors.Wrap(err, "find files")
+		}
 
-	if err := f.db.Delete(oldFiles).Error; err != nil {
-		return errors.Wrap(err, "delete rename remains")
-	}
+		var bytes, files int64
+		for _, file := range oldFiles {
+			if !file.IsDir {
+				bytes += int64(len(file.Data))
+				files++
+			}
+		}
+		now := f.now()
+		return f.transaction(func(tx *GormFs) error {
+			if err := tx.claimFiles(oldFiles); err != nil {
+				return err
+			}
+			if err := tx.table(&File{}).Delete(oldFiles).Error; err != nil {
+				return errors.Wrap(err, "delete rename remains")
+			}
 
-	return nil
+			newFiles := make([]*File, len(oldFiles))
+			for i := range oldFiles {
+				f := *oldFiles[i]
+				newFiles[i] = &f
+				fnn := strings.TrimPrefix(oldFiles[i].Name, oldname)
+				newFiles[i].Name = newname + fnn
+				newFiles[i].MTime = now
+			}
+			if err := tx.table(&File{}).Save(newFiles).Error; err != nil {
+				return errors.Wrap(err, "save files")
+			}
+			if err := tx.checkTreeQuota("rename", newname, bytes, files, oldname); err != nil {
+				return err
+			}
+			return tx.record(OpRename, JournalEntry{Op: JournalRename, Name: oldname, NewName: newname})
+		})
+	})
 }
 
-func (f *GormFs) Stat(name string) (fs.FileInfo, error) {
-	file, err := newAferoFile(f.db, name, os.O_RDONLY)
+func (f *GormFs) Stat(name string) (info fs.FileInfo, err error) {
+	f, end := f.begin("stat", name)
+	defer end(&err)
+	file, err := f.loadFile(filepath.Clean(name))
 	if err != nil {
 		return nil, err
 	}
+	return &fileInfo{file}, nil
+}
 
-	return file.Stat()
+// writable returns a permission error when f is read-only, see WithReadOnly.
+func (f *GormFs) writable(op, name string) error {
+	if f.readOnly {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return nil
 }
 
 func (f *GormFs) hasParent(name string) bool {
@@ -196,7 +456,8 @@ func (f *GormFs) hasParent(name string) bool {
 	if parent == "." || parent == "/" { // FIXME: breaks on non-unix
 		return true
 	}
-	return f.db.Where("name = ? AND is_dir = true", parent).Limit(1).Find(&File{}).RowsAffected != 0
+	file, err := f.loadFile(parent)
+	return err == nil && file.IsDir
 }
 
 func (f *GormFs) exists(name string) bool {
@@ -204,5 +465,124 @@ func (f *GormFs) exists(name string) bool {
 	if name == "." || name == "/" { // FIXME: breaks on non-unix
 		return true
 	}
-	return f.db.Where("name = ?", name).Limit(1).Find(&File{}).RowsAffected != 0
+	_, err := f.loadFile(name)
+	return err == nil
+}
+
+// errUnchanged can be returned by the callback of updateFile when there is nothing to save,
+// updateFile then returns it as is.
+var errUnchanged = errors.New("unchanged")
+
+// errStale is returned within transactions when a file was updated since it was read,
+// see retryStale.
+var errStale = errors.New("stale file")
+
+// retryStale calls fn until it does not fail with errStale, failing with ErrConflict after
+// maxUpdateAttempts attempts.
+func retryStale(op, name string, fn func() error) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		if err := fn(); err != errStale {
+			return err
+		}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: ErrConflict}
+}
+
+// updateFile applies change to the latest version of name and saves it, retrying when a
+// concurrent update was saved in between. The saved file is passed to then, if not nil,
+// in the transaction of the update.
+func (f *GormFs) updateFile(op, name string, change func(file *File) error, then func(tx *GormFs, file *File) error) (*File, error) {
+	name = filepath.Clean(name)
+	var file *File
+	err := retryStale(op, name, func() error {
+		var err error
+		if file, err = getFile(f.table(&File{}), name, f.now()); err != nil {
+			return err
+		}
+		if err := change(file); err != nil {
+			return err
+		}
+		return f.transaction(func(tx *GormFs) error {
+			if name == "." || name == "/" { // FIXME: breaks on non-unix
+				if err := tx.table(&File{}).Save(file).Error; err != nil {
+					return err
+				}
+			} else {
+				version := file.Version
+				file.Version++
+				res := tx.table(&File{}).Where("version = ?", version).Select("*").Updates(file)
+				if res.Error != nil {
+					return errors.Wrap(res.Error, "update file")
+				}
+				if res.RowsAffected == 0 {
+					return errStale
+				}
+			}
+			if then == nil {
+				return nil
+			}
+			return then(tx, file)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// claimFiles bumps the versions of files, failing with errStale if one of them was updated
+// since it was read, so that the concurrent updates based on what they were conflict.
+func (f *GormFs) claimFiles(files []*File) error {
+	for _, file := range files {
+		res := f.table(&File{}).Where("name = ? AND version = ?", file.Name, file.Version).Update("version", file.Version+1)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "claim file")
+		}
+		if res.RowsAffected == 0 {
+			return errStale
+		}
+		file.Version++
+	}
+	return nil
+}
+
+// txState is shared by the filesystems of a transaction.
+type txState struct {
+	// committed are run once the transaction is committed.
+	committed []func()
+}
+
+// transaction runs fn with a filesystem whose queries are part of a single transaction,
+// committed if fn returns nil along with the audit entry of the operation of f, if not
+// recorded yet. Within a transaction, fn runs in it.
+func (f *GormFs) transaction(fn func(tx *GormFs) error) error {
+	if f.tx != nil {
+		return fn(f)
+	}
+	state := &txState{}
+	err := f.db.Transaction(func(db *gorm.DB) error {
+		tx := *f
+		tx.db = db
+		tx.tx = state
+		if err := fn(&tx); err != nil {
+			return err
+		}
+		return tx.auditMutation()
+	})
+	if err != nil {
+		return err
+	}
+	for _, committed := range state.committed {
+		committed()
+	}
+	return nil
+}
+
+// afterCommit runs fn once the transaction of f is committed, or right away outside transactions.
+func (f *GormFs) afterCommit(fn func()) {
+	if f.tx == nil {
+		fn()
+		return
+	}
+	f.tx.committed = append(f.tx.committed, fn)
 }
@@ -10,13 +10,13 @@ import (
 	"gorm.io/gorm"
 )
 
-func TestingFs(t *testing.T) *GormFs {
+func TestingFs(t *testing.T, opts ...Option) *GormFs {
 	t.Helper()
 
 	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "fs.db")), &gorm.Config{})
 	require.NoError(t, err)
 
-	fs, err := NewGormFs(db)
+	fs, err := NewGormFs(db, opts...)
 	require.NoError(t, err)
 
 	return fs
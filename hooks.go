@@ -0,0 +1,104 @@
+package gormfs
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+)
+
+// HookOp is an operation that hooks run around.
+type HookOp string
+
+const (
+	// HookCreate is the creation of a file by Create or OpenFile, or of each file copied by Copy
+	// or CopyTree, the first veto failing the whole copy.
+	HookCreate HookOp = "create"
+	// HookWriteClose is the closing of a handle through which the file was modified. It runs once
+	// the content is stored and cannot be vetoed: the error of a Before hook is only returned by Close.
+	HookWriteClose HookOp = "write-close"
+	HookRename     HookOp = "rename"
+	// HookRemove is the removal of an entry by Remove, or of a tree by RemoveAll.
+	HookRemove HookOp = "remove"
+	HookChmod  HookOp = "chmod"
+)
+
+// HookEvent describes an operation to hooks.
+type HookEvent struct {
+	Op   HookOp
+	Path string
+	// NewPath is the destination of renames.
+	NewPath string
+	// Mode is the requested mode of chmods.
+	Mode fs.FileMode
+}
+
+// Hooks run around the operations of a GormFs, see WithHooks. ctx is the context given to WithContext.
+type Hooks interface {
+	// Before runs before the operation, which fails with the returned error instead of being done
+	// if it is not nil, see HookWriteClose for the exception.
+	Before(ctx context.Context, ev HookEvent) error
+	// After runs once the operation was done, err being its outcome.
+	After(ctx context.Context, ev HookEvent, err error)
+}
+
+func (ev HookEvent) clean() HookEvent {
+	ev.Path = filepath.Clean(ev.Path)
+	if ev.NewPath != "" {
+		ev.NewPath = filepath.Clean(ev.NewPath)
+	}
+	return ev
+}
+
+// HookFuncs implements Hooks with functions, nil ones being skipped.
+type HookFuncs struct {
+	BeforeFunc func(ctx context.Context, ev HookEvent) error
+	AfterFunc  func(ctx context.Context, ev HookEvent, err error)
+}
+
+var _ Hooks = HookFuncs{}
+
+func (h HookFuncs) Before(ctx context.Context, ev HookEvent) error {
+	if h.BeforeFunc == nil {
+		return nil
+	}
+	return h.BeforeFunc(ctx, ev)
+}
+
+func (h HookFuncs) After(ctx context.Context, ev HookEvent, err error) {
+	if h.AfterFunc != nil {
+		h.AfterFunc(ctx, ev, err)
+	}
+}
+
+// WithHooks runs hooks around the operations of the filesystem, in order, once the entries they
+// act on were checked. The first veto stops the operation, the After hooks then not being run.
+func WithHooks(hooks ...Hooks) Option {
+	return func(f *GormFs) {
+		f.hooks = append(f.hooks, hooks...)
+	}
+}
+
+// before runs the Before hooks of f, returning the first veto as a path error.
+func (f *GormFs) before(ev HookEvent) error {
+	if len(f.hooks) == 0 {
+		return nil
+	}
+	ev = ev.clean()
+	for _, h := range f.hooks {
+		if err := h.Before(f.context(), ev); err != nil {
+			return &fs.PathError{Op: string(ev.Op), Path: ev.Path, Err: err}
+		}
+	}
+	return nil
+}
+
+// after runs the After hooks of f with *err, meant to be deferred once before succeeded.
+func (f *GormFs) after(ev HookEvent, err *error) {
+	if len(f.hooks) == 0 {
+		return
+	}
+	ev = ev.clean()
+	for _, h := range f.hooks {
+		h.After(f.context(), ev, *err)
+	}
+}
@@ -0,0 +1,170 @@
+package gormfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooks(t *testing.T) {
+	errVirus := errors.New("virus found")
+	events := []string{}
+	veto := HookFuncs{BeforeFunc: func(ctx context.Context, ev HookEvent) error {
+		if ev.Op == HookCreate && filepath.Ext(ev.Path) == ".exe" {
+			return errVirus
+		}
+		return nil
+	}}
+	record := HookFuncs{
+		BeforeFunc: func(ctx context.Context, ev HookEvent) error {
+			events = append(events, fmt.Sprintf("before %s %s", ev.Op, ev.Path))
+			return nil
+		},
+		AfterFunc: func(ctx context.Context, ev HookEvent, err error) {
+			s := fmt.Sprintf("after %s %s", ev.Op, ev.Path)
+			if ev.NewPath != "" {
+				s += " " + ev.NewPath
+			}
+			if ev.Op == HookChmod {
+				s += " " + ev.Mode.String()
+			}
+			if err != nil {
+				s += " failed"
+			}
+			if actor, ok := ctx.Value(actorKey{}).(string); ok {
+				s += " by " + actor
+			}
+			events = append(events, s)
+		},
+	}
+	gfs, err := NewGormFs(testingDB(t), WithHooks(veto, record))
+	require.NoError(t, err)
+
+	_, err = gfs.Create("/setup.exe")
+	require.True(t, errors.Is(err, errVirus))
+	_, err = gfs.OpenFile("/other.exe", os.O_CREATE|os.O_WRONLY, 0644)
+	require.True(t, errors.Is(err, errVirus))
+	exists, err := afero.Exists(gfs, "/setup.exe")
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.Empty(t, events, "vetoed operations do not reach the next hooks")
+
+	alice := gfs.WithContext(ContextWithActor(context.Background(), "alice"))
+	require.NoError(t, afero.WriteFile(alice, "/doc", []byte("hello"), 0644))
+	_, err = afero.ReadFile(gfs, "/doc")
+	require.NoError(t, err)
+	require.NoError(t, gfs.Chmod("/doc", 0600))
+	require.NoError(t, gfs.Rename("/doc", "/renamed"))
+	require.Error(t, gfs.Remove("/missing"))
+	require.NoError(t, gfs.RemoveAll("/missing"))
+	require.NoError(t, gfs.Remove("/renamed"))
+
+	require.Equal(t, []string{
+		"before create /doc",
+		"after create /doc by alice",
+		"before write-close /doc",
+		"after write-close /doc by alice",
+		"before chmod /doc",
+		"after chmod /doc -rw-------",
+		"before rename /doc",
+		"after rename /doc /renamed",
+		"before remove /renamed",
+		"after remove /renamed",
+	}, events)
+}
+
+func TestWriteCloseError(t *testing.T) {
+	errRejected := errors.New("rejected")
+	gfs, err := NewGormFs(testingDB(t), WithHooks(HookFuncs{BeforeFunc: func(ctx context.Context, ev HookEvent) error {
+		if ev.Op == HookWriteClose {
+			return errRejected
+		}
+		return nil
+	}}))
+	require.NoError(t, err)
+
+	f, err := gfs.Create("/file")
+	require.NoError(t, err)
+	require.NoError(t, f.Close(), "nothing was written")
+
+	f, err = gfs.OpenFile("/file", os.O_WRONLY, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.(Locker).Lock(LockExclusive))
+	_, err = f.Write([]byte("content"))
+	require.NoError(t, err)
+	require.True(t, errors.Is(f.Close(), errRejected))
+
+	// the lock was released anyway and the content is stored
+	g, err := gfs.Open("/file")
+	require.NoError(t, err)
+	require.NoError(t, g.(Locker).TryLock(LockExclusive))
+	require.NoError(t, g.Close())
+	data, err := afero.ReadFile(gfs, "/file")
+	require.NoError(t, err)
+	require.Equal(t, "content", string(data))
+}
+
+func TestCopyHooks(t *testing.T) {
+	errRejected := errors.New("rejected")
+	events := []string{}
+	gfs, err := NewGormFs(testingDB(t), WithHooks(HookFuncs{
+		BeforeFunc: func(ctx context.Context, ev HookEvent) error {
+			if ev.Path == "/vetoed/b" {
+				return errRejected
+			}
+			events = append(events, fmt.Sprintf("before %s %s", ev.Op, ev.Path))
+			return nil
+		},
+		AfterFunc: func(ctx context.Context, ev HookEvent, err error) {
+			events = append(events, fmt.Sprintf("after %s %s", ev.Op, ev.Path))
+		},
+	}))
+	require.NoError(t, err)
+	require.NoError(t, gfs.MkdirAll("/src/sub", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/src/a", nil, 0644))
+	require.NoError(t, afero.WriteFile(gfs, "/src/sub/b", nil, 0644))
+	events = events[:0]
+
+	require.NoError(t, gfs.Copy("/src/a", "/copy"))
+	require.NoError(t, gfs.CopyTree("/src", "/tree"))
+	require.Equal(t, []string{
+		"before create /copy",
+		"after create /copy",
+		"before create /tree/a",
+		"before create /tree/sub/b",
+		"after create /tree/a",
+		"after create /tree/sub/b",
+	}, events)
+
+	require.True(t, errors.Is(gfs.CopyTree("/src/sub", "/vetoed"), errRejected))
+	exists, err := afero.Exists(gfs, "/vetoed")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestHooksSkipFailedChecks(t *testing.T) {
+	events := []string{}
+	gfs, err := NewGormFs(testingDB(t), WithHooks(HookFuncs{BeforeFunc: func(ctx context.Context, ev HookEvent) error {
+		events = append(events, fmt.Sprintf("%s %s", ev.Op, ev.Path))
+		return nil
+	}}))
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(gfs, "/file", nil, 0644))
+	require.NoError(t, gfs.Mkdir("/dir", 0755))
+	events = events[:0]
+
+	require.Error(t, gfs.Chmod("/missing", 0600))
+	require.Error(t, gfs.Rename("/missing", "/other"))
+	require.Error(t, gfs.Copy("/missing", "/other"))
+	require.Error(t, gfs.Copy("/file", "/dir"))
+	require.Error(t, gfs.Copy("/file", "/missing/file"))
+	require.Error(t, gfs.Copy("/dir", "/other"))
+	require.Error(t, gfs.CopyTree("/dir", "/dir/sub"))
+	require.Empty(t, events)
+}
@@ -0,0 +1,78 @@
+package gormfs
+
+import (
+	"bytes"
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// ErrIntegrity is returned when the content of a file does not match its checksum.
+var ErrIntegrity = errors.New("checksum mismatch")
+
+// Checksummed is implemented by the Sys value of the file infos returned by GormFs.
+type Checksummed interface {
+	// Checksum returns the SHA-256 of the file content, or nil for directories and
+	// files whose checksum was never computed.
+	Checksum() []byte
+}
+
+var _ Checksummed = (*fileInfo)(nil)
+
+// WithVerifyOnRead makes the first read of every handle check the content of the file
+// against its checksum.
+func WithVerifyOnRead() Option {
+	return func(f *GormFs) {
+		f.verifyOnRead = true
+	}
+}
+
+// Verify checks the content of name against its checksum, computing the checksum
+// if it was never stored, unless f is read-only.
+func (f *GormFs) Verify(name string) error {
+	file, err := getFile(f.table(&File{}), name, f.now())
+	if err != nil {
+		return err
+	}
+	if file.IsDir {
+		return nil
+	}
+
+	if file.Hash == nil {
+		if f.readOnly {
+			return nil
+		}
+		_, err := f.updateFile("verify", file.Name, func(latest *File) error {
+			if latest.Hash != nil {
+				return errUnchanged
+			}
+			latest.Hash = contentHash(latest.Data)
+			return nil
+		}, nil)
+		if err != nil && err != errUnchanged {
+			return errors.Wrap(err, "store checksum")
+		}
+		return nil
+	}
+	if !bytes.Equal(contentHash(file.Data), file.Hash) {
+		return &fs.PathError{Op: "verify", Path: file.Name, Err: ErrIntegrity}
+	}
+	return nil
+}
+
+// verify checks the file of af once per handle when WithVerifyOnRead is set.
+func (af *aferoFile) verify(g *GormFs) error {
+	af.mu.Lock()
+	verified := af.verified
+	af.mu.Unlock()
+	if !g.verifyOnRead || verified {
+		return nil
+	}
+	if err := g.Verify(af.name); err != nil {
+		return err
+	}
+	af.mu.Lock()
+	af.verified = true
+	af.mu.Unlock()
+	return nil
+}
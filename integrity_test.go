@@ -0,0 +1,78 @@
+package gormfs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumInSys(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.Mkdir("/dir", 0755))
+	f, err := gfs.Create("/empty")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("content"), 0644))
+
+	checksum := func(name string) []byte {
+		info, err := gfs.Stat(name)
+		require.NoError(t, err)
+		c, ok := info.Sys().(Checksummed)
+		require.True(t, ok)
+		return c.Checksum()
+	}
+
+	empty := sha256.Sum256(nil)
+	require.Equal(t, empty[:], checksum("/empty"))
+	sum := sha256.Sum256([]byte("content"))
+	require.Equal(t, sum[:], checksum("/file"))
+	require.Nil(t, checksum("/dir"))
+
+	f, err = gfs.OpenFile("/file", os.O_RDWR, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(3))
+	require.NoError(t, f.Close())
+	sum = sha256.Sum256([]byte("con"))
+	require.Equal(t, sum[:], checksum("/file"))
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("content"), 0644))
+	require.NoError(t, gfs.Verify("/file"))
+
+	// corrupted behind the back of GormFs
+	require.NoError(t, gfs.table(&File{}).Where("name = ?", "/file").Update("data", []byte("c0ntent")).Error)
+
+	require.True(t, errors.Is(gfs.Verify("/file"), ErrIntegrity))
+	_, err := afero.ReadFile(gfs, "/file")
+	require.NoError(t, err, "verification is disabled by default")
+
+	verifying, err := NewGormFs(gfs.db, WithVerifyOnRead())
+	require.NoError(t, err)
+	_, err = afero.ReadFile(verifying, "/file")
+	require.True(t, errors.Is(err, ErrIntegrity))
+	f, err := verifying.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.ReadAt(make([]byte, 4), 2)
+	require.True(t, errors.Is(err, ErrIntegrity))
+
+	// a missing checksum is computed instead
+	require.NoError(t, gfs.table(&File{}).Where("name = ?", "/file").Update("hash", nil).Error)
+	data, err := afero.ReadFile(verifying, "/file")
+	require.NoError(t, err)
+	require.Equal(t, "c0ntent", string(data))
+	f2, err := verifying.Open("/file")
+	require.NoError(t, err)
+	defer f2.Close()
+	data, err = io.ReadAll(f2)
+	require.NoError(t, err)
+	require.Equal(t, "c0ntent", string(data))
+	require.NoError(t, gfs.Verify("/file"))
+}
@@ -0,0 +1,182 @@
+package gormfs
+
+import (
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type JournalOp string
+
+const (
+	JournalCreate    JournalOp = "create"
+	JournalMkdir     JournalOp = "mkdir"
+	JournalWrite     JournalOp = "write"
+	JournalTruncate  JournalOp = "truncate"
+	JournalChmod     JournalOp = "chmod"
+	JournalChown     JournalOp = "chown"
+	JournalChtimes   JournalOp = "chtimes"
+	JournalRename    JournalOp = "rename"
+	JournalRemove    JournalOp = "remove"
+	JournalRemoveAll JournalOp = "remove_all"
+	JournalCopy      JournalOp = "copy"
+	JournalExpire    JournalOp = "expire"
+)
+
+// JournalEntry describes one mutation with enough detail to replay it, see ApplyJournal.
+type JournalEntry struct {
+	Seq     uint64 `gorm:"primaryKey;autoIncrement"`
+	Time    time.Time
+	Op      JournalOp
+	Name    string
+	NewName string
+	Mode    fs.FileMode
+	User    int
+	Group   int
+	ATime   time.Time
+	MTime   time.Time
+	// Offset and Data are the position and bytes of a write, Size is the length after a truncate.
+	Offset int64
+	Size   int64
+	Data   []byte
+	// ExpiresAt is the expiry set by a create or expire operation.
+	ExpiresAt *time.Time
+	// Origin is the replica whose changes were being applied, empty for local operations.
+	Origin string
+}
+
+// WithJournal appends every mutation to the journal_entries table.
+func WithJournal() Option {
+	return func(f *GormFs) {
+		f.journalEnabled = true
+	}
+}
+
+// Journal returns up to limit entries recorded after cursor, oldest first.
+// The Seq of the last returned entry is the cursor for the next call.
+func (f *GormFs) Journal(cursor uint64, limit int) ([]JournalEntry, error) {
+	entries := []JournalEntry{}
+	if err := f.table(&JournalEntry{}).Where("seq > ?", cursor).Order("seq").Limit(limit).Find(&entries).Error; err != nil {
+		return nil, errors.Wrap(err, "list journal entries")
+	}
+	return entries, nil
+}
+
+// CompactJournal deletes entries up to and including upTo. The newest entry is always
+// kept so that sequence numbers are never reused.
+func (f *GormFs) CompactJournal(upTo uint64) (int64, error) {
+	if err := f.writable("compact", "/"); err != nil {
+		return 0, err
+	}
+	var last uint64
+	if err := f.table(&JournalEntry{}).Select("COALESCE(MAX(seq), 0)").Scan(&last).Error; err != nil {
+		return 0, errors.Wrap(err, "find last journal entry")
+	}
+	if last == 0 {
+		return 0, nil
+	}
+	if upTo >= last {
+		upTo = last - 1
+	}
+	res := f.table(&JournalEntry{}).Where("seq <= ?", upTo).Delete(&JournalEntry{})
+	if res.Error != nil {
+		return 0, errors.Wrap(res.Error, "compact journal")
+	}
+	return res.RowsAffected, nil
+}
+
+// ApplyJournal replays entries, typically read from another filesystem's journal, on f.
+func (f *GormFs) ApplyJournal(entries []JournalEntry) error {
+	for _, entry := range entries {
+		if err := f.applyJournalEntry(entry); err != nil {
+			return errors.Wrapf(err, "apply journal entry %d", entry.Seq)
+		}
+	}
+	return nil
+}
+
+func (f *GormFs) applyJournalEntry(entry JournalEntry) error {
+	switch entry.Op {
+	case JournalCreate:
+		file, err := f.OpenFile(entry.Name, os.O_CREATE|os.O_RDWR, entry.Mode)
+		if err != nil {
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		if entry.ExpiresAt != nil {
+			return f.SetExpiry(entry.Name, *entry.ExpiresAt)
+		}
+		return nil
+	case JournalMkdir:
+		if err := f.Mkdir(entry.Name, entry.Mode.Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	case JournalWrite, JournalTruncate:
+		file, err := f.OpenFile(entry.Name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if entry.Op == JournalTruncate {
+			return file.Truncate(entry.Size)
+		}
+		_, err = file.WriteAt(entry.Data, entry.Offset)
+		return err
+	case JournalChmod:
+		return f.Chmod(entry.Name, entry.Mode)
+	case JournalChown:
+		return f.Chown(entry.Name, entry.User, entry.Group)
+	case JournalChtimes:
+		return f.Chtimes(entry.Name, entry.ATime, entry.MTime)
+	case JournalRename:
+		return f.Rename(entry.Name, entry.NewName)
+	case JournalRemove:
+		return f.Remove(entry.Name)
+	case JournalRemoveAll:
+		return f.RemoveAll(entry.Name)
+	case JournalExpire:
+		var expiresAt time.Time
+		if entry.ExpiresAt != nil {
+			expiresAt = *entry.ExpiresAt
+		}
+		return f.SetExpiry(entry.Name, expiresAt)
+	case JournalCopy:
+		return f.CopyTree(entry.Name, entry.NewName)
+	}
+	return errors.Errorf("unknown journal operation %q", entry.Op)
+}
+
+func (f *GormFs) journal(entry JournalEntry) error {
+	if !f.journalEnabled {
+		return nil
+	}
+	entry.Time = f.now()
+	entry.Origin = f.origin
+	if err := f.table(&JournalEntry{}).Create(&entry).Error; err != nil {
+		return errors.Wrap(err, "append journal entry")
+	}
+	return nil
+}
+
+// record journals entry and notifies watchers of op, in the transaction of the mutation
+// so that the journal never diverges from the files.
+func (f *GormFs) record(op Op, entry JournalEntry) error {
+	f.invalidateCache(entry)
+	if err := f.journal(entry); err != nil {
+		return err
+	}
+	if op != OpChmod || entry.Op == JournalExpire {
+		if err := f.invalidateHashes(entry.Name, entry.NewName); err != nil {
+			return err
+		}
+	}
+	if op == OpRename {
+		return f.notify(op, entry.NewName, entry.Name)
+	}
+	return f.notify(op, entry.Name, "")
+}
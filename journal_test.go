@@ -0,0 +1,110 @@
+package gormfs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalReplay(t *testing.T) {
+	src := TestingFs(t, WithJournal())
+	mtime := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, src.MkdirAll("/a/b", 0755))
+	require.NoError(t, afero.WriteFile(src, "/a/b/file", []byte("hello world"), 0644))
+	f, err := src.OpenFile("/a/b/file", os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("HELLO"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(8))
+	require.NoError(t, f.Close())
+	require.NoError(t, src.Chmod("/a/b/file", 0600))
+	require.NoError(t, src.Chown("/a/b/file", 1000, 1000))
+	require.NoError(t, src.Rename("/a/b", "/a/c"))
+	require.NoError(t, src.Chtimes("/a/c/file", mtime, mtime))
+	require.NoError(t, afero.WriteFile(src, "/a/tmp", []byte("tmp"), 0644))
+	require.NoError(t, src.Remove("/a/tmp"))
+
+	first, err := src.Journal(0, 3)
+	require.NoError(t, err)
+	require.Len(t, first, 3)
+	require.Equal(t, JournalMkdir, first[0].Op)
+	rest, err := src.Journal(first[len(first)-1].Seq, 1000)
+	require.NoError(t, err)
+	require.Equal(t, JournalRemove, rest[len(rest)-1].Op)
+	for i := 1; i < len(rest); i++ {
+		require.Greater(t, rest[i].Seq, rest[i-1].Seq)
+	}
+
+	dst := TestingFs(t)
+	require.NoError(t, dst.ApplyJournal(append(first, rest...)))
+
+	data, err := afero.ReadFile(dst, "/a/c/file")
+	require.NoError(t, err)
+	require.Equal(t, "HELLO wo", string(data))
+	info, err := dst.Stat("/a/c/file")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode())
+	require.True(t, mtime.Equal(info.ModTime()))
+	require.Equal(t, 1000, info.(*fileInfo).User)
+	_, err = dst.Stat("/a/tmp")
+	require.True(t, os.IsNotExist(err))
+	_, err = dst.Stat("/a/b")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCompactJournal(t *testing.T) {
+	gfs := TestingFs(t, WithJournal())
+
+	n, err := gfs.CompactJournal(10)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	for _, name := range []string{"/a", "/b", "/c"} {
+		require.NoError(t, gfs.Mkdir(name, 0755))
+	}
+	entries, err := gfs.Journal(0, 100)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	last := entries[2].Seq
+
+	n, err = gfs.CompactJournal(last)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+
+	require.NoError(t, gfs.Mkdir("/d", 0755))
+	entries, err = gfs.Journal(0, 100)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, last, entries[0].Seq)
+	require.Greater(t, entries[1].Seq, last)
+}
+
+func TestJournalFailureRollsBack(t *testing.T) {
+	fs := TestingFs(t, WithJournal())
+	require.NoError(t, afero.WriteFile(fs, "/file", []byte("data"), 0644))
+	require.NoError(t, fs.db.Migrator().DropTable(fs.tableName(&JournalEntry{})))
+
+	require.Error(t, fs.Chmod("/file", 0600))
+	require.Error(t, fs.Mkdir("/dir", 0755))
+	require.Error(t, fs.Rename("/file", "/renamed"))
+	require.Error(t, fs.Remove("/file"))
+	f, err := fs.OpenFile("/file", os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("lost"))
+	require.Error(t, err)
+	require.NoError(t, f.Close())
+
+	info, err := fs.Stat("/file")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode())
+	exists, err := afero.Exists(fs, "/dir")
+	require.NoError(t, err)
+	require.False(t, exists)
+	data, err := afero.ReadFile(fs, "/file")
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+}
@@ -0,0 +1,199 @@
+package gormfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrLocked    = errors.New("file is locked")
+	ErrNotLocked = errors.New("file is not locked")
+)
+
+const DefaultLockLease = 30 * time.Second
+
+type LockMode int
+
+const (
+	// LockShared can be held by many handles at once, as long as nobody holds LockExclusive.
+	LockShared LockMode = iota + 1
+	// LockExclusive can only be held by a single handle.
+	LockExclusive
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case LockShared:
+		return "shared"
+	case LockExclusive:
+		return "exclusive"
+	}
+	return "unknown"
+}
+
+// Locker is implemented by the files returned by GormFs.
+// Locks are advisory: reads and writes do not check them.
+type Locker interface {
+	// Lock waits until the lock is acquired. Calling it while holding a lock changes its mode.
+	Lock(mode LockMode) error
+	// TryLock returns ErrLocked instead of waiting.
+	TryLock(mode LockMode) error
+	Unlock() error
+}
+
+var _ Locker = (*aferoFile)(nil)
+
+// FileLock is a row of the lock table. A lock whose lease expired is ignored,
+// so that crashed processes do not keep files locked forever.
+type FileLock struct {
+	ID        uint64 `gorm:"primaryKey;autoIncrement"`
+	Name      string
+	Owner     string
+	Mode      LockMode
+	ExpiresAt time.Time
+}
+
+// WithLockLease sets how long locks stay valid without being renewed, DefaultLockLease by default.
+// Held locks are renewed in the background.
+func WithLockLease(lease time.Duration) Option {
+	return func(f *GormFs) {
+		f.lockLease = lease
+	}
+}
+
+func (f *GormFs) lease() time.Duration {
+	if f.lockLease <= 0 {
+		return DefaultLockLease
+	}
+	return f.lockLease
+}
+
+type heldLock struct {
+	id   uint64
+	mode LockMode
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (af *aferoFile) Lock(mode LockMode) error {
+	for {
+		err := af.TryLock(mode)
+		if pe, ok := err.(*fs.PathError); !ok || pe.Err != ErrLocked {
+			return err
+		}
+		wait, err := rand.Int(rand.Reader, big.NewInt(int64(50*time.Millisecond)))
+		if err != nil {
+			return err
+		}
+		time.Sleep(50*time.Millisecond + time.Duration(wait.Int64()))
+	}
+}
+
+func (af *aferoFile) TryLock(mode LockMode) error {
+	if err := af.fs.writable("lock", af.name); err != nil {
+		return err
+	}
+	if mode != LockShared && mode != LockExclusive {
+		return errors.Errorf("invalid lock mode %d", mode)
+	}
+
+	af.lockMu.Lock()
+	defer af.lockMu.Unlock()
+	if af.lock != nil && af.lock.mode == mode {
+		return nil
+	}
+	if af.owner == "" {
+		owner, err := lockOwner()
+		if err != nil {
+			return err
+		}
+		af.owner = owner
+	}
+
+	// The new lock is inserted before looking for conflicting ones, so that two
+	// processes racing for the same file cannot both win.
+	now := time.Now()
+	if err := af.fs.table(&FileLock{}).Where("name = ? AND expires_at <= ?", af.name, now).Delete(&FileLock{}).Error; err != nil {
+		return errors.Wrap(err, "delete expired locks")
+	}
+	lock := &FileLock{Name: af.name, Owner: af.owner, Mode: mode, ExpiresAt: now.Add(af.fs.lease())}
+	if err := af.fs.table(&FileLock{}).Create(lock).Error; err != nil {
+		return errors.Wrap(err, "insert lock")
+	}
+
+	conflicts := af.fs.table(&FileLock{}).Where("name = ? AND owner <> ? AND expires_at > ?", af.name, af.owner, now)
+	if mode == LockShared {
+		conflicts = conflicts.Where("mode = ?", LockExclusive)
+	}
+	var count int64
+	if err := conflicts.Count(&count).Error; err != nil {
+		return errors.Wrap(err, "find conflicting locks")
+	}
+	if count != 0 {
+		if err := af.fs.table(&FileLock{}).Delete(lock).Error; err != nil {
+			return errors.Wrap(err, "delete lock")
+		}
+		return &fs.PathError{Op: "lock", Path: af.name, Err: ErrLocked}
+	}
+
+	if af.lock != nil {
+		if err := af.releaseLock(); err != nil {
+			return err
+		}
+	}
+	af.lock = &heldLock{id: lock.ID, mode: mode, stop: make(chan struct{}), done: make(chan struct{})}
+	go af.fs.renewLock(af.lock)
+	return nil
+}
+
+func (af *aferoFile) Unlock() error {
+	af.lockMu.Lock()
+	defer af.lockMu.Unlock()
+	if af.lock == nil {
+		return &fs.PathError{Op: "unlock", Path: af.name, Err: ErrNotLocked}
+	}
+	return af.releaseLock()
+}
+
+func (af *aferoFile) releaseLock() error {
+	close(af.lock.stop)
+	<-af.lock.done
+	id := af.lock.id
+	af.lock = nil
+	if err := af.fs.table(&FileLock{}).Delete(&FileLock{ID: id}).Error; err != nil {
+		return errors.Wrap(err, "delete lock")
+	}
+	return nil
+}
+
+// renewLock extends the lease of lock until it is released.
+func (f *GormFs) renewLock(lock *heldLock) {
+	defer close(lock.done)
+	ticker := time.NewTicker(f.lease() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+			// a failed renewal is retried on the next tick, the lock is lost if the lease expires meanwhile
+			f.table(&FileLock{}).Where("id = ?", lock.id).Update("expires_at", time.Now().Add(f.lease()))
+		}
+	}
+}
+
+func lockOwner() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "generate lock owner")
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(id)), nil
+}
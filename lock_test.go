@@ -0,0 +1,93 @@
+package gormfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func openLocker(t *testing.T, gfs *GormFs, name string) (afero.File, Locker) {
+	t.Helper()
+	f, err := gfs.OpenFile(name, os.O_RDWR, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f, f.(Locker)
+}
+
+func TestLockModes(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(gfs, "/file", nil, 0644))
+
+	_, a := openLocker(t, gfs, "/file")
+	_, b := openLocker(t, gfs, "/file")
+	_, c := openLocker(t, gfs, "/file")
+
+	require.NoError(t, a.TryLock(LockShared))
+	require.NoError(t, b.TryLock(LockShared))
+	require.True(t, errors.Is(c.TryLock(LockExclusive), ErrLocked))
+	require.True(t, errors.Is(a.TryLock(LockExclusive), ErrLocked), "upgrade while shared by others")
+
+	require.NoError(t, b.Unlock())
+	require.NoError(t, a.TryLock(LockExclusive))
+	require.True(t, errors.Is(b.TryLock(LockShared), ErrLocked))
+	require.True(t, errors.Is(c.TryLock(LockExclusive), ErrLocked))
+
+	require.NoError(t, a.TryLock(LockShared), "downgrade")
+	require.NoError(t, b.TryLock(LockShared))
+
+	require.NoError(t, a.Unlock())
+	require.True(t, errors.Is(a.Unlock(), ErrNotLocked))
+	require.NoError(t, b.Unlock())
+	require.NoError(t, c.TryLock(LockExclusive))
+}
+
+func TestLockReleasedOnClose(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(gfs, "/file", nil, 0644))
+
+	fa, a := openLocker(t, gfs, "/file")
+	_, b := openLocker(t, gfs, "/file")
+
+	require.NoError(t, a.Lock(LockExclusive))
+	acquired := make(chan error)
+	go func() { acquired <- b.Lock(LockExclusive) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while held")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	require.NoError(t, fa.Close())
+	select {
+	case err := <-acquired:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not acquired after close")
+	}
+}
+
+func TestLockLease(t *testing.T) {
+	gfs := TestingFs(t, WithLockLease(150*time.Millisecond))
+	require.NoError(t, afero.WriteFile(gfs, "/file", nil, 0644))
+
+	_, a := openLocker(t, gfs, "/file")
+	_, b := openLocker(t, gfs, "/file")
+
+	// held locks are renewed
+	require.NoError(t, a.TryLock(LockExclusive))
+	time.Sleep(400 * time.Millisecond)
+	require.True(t, errors.Is(b.TryLock(LockExclusive), ErrLocked))
+
+	require.NoError(t, a.Unlock())
+
+	// locks of crashed owners are not renewed and expire
+	require.NoError(t, gfs.table(&FileLock{}).Create(&FileLock{
+		Name: "/file", Owner: "crashed", Mode: LockExclusive, ExpiresAt: time.Now().Add(-time.Second),
+	}).Error)
+	require.NoError(t, b.TryLock(LockExclusive))
+}
@@ -0,0 +1,232 @@
+package gormfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type DiffKind int
+
+const (
+	// DiffAdded entries only exist in the other tree.
+	DiffAdded DiffKind = iota
+	// DiffRemoved entries only exist in this tree.
+	DiffRemoved
+	DiffModified
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+type Difference struct {
+	Kind DiffKind
+	// Path is relative to the compared roots, with forward slashes.
+	Path  string
+	IsDir bool
+}
+
+// TreeHash returns the SHA-256 of a file content, or the Merkle hash of a directory,
+// computed from the names, types and hashes of its children.
+func (f *GormFs) TreeHash(name string) ([]byte, error) {
+	file, err := getFile(f.table(&File{}), name, f.now())
+	if err != nil {
+		return nil, err
+	}
+	return f.entryHash(file)
+}
+
+// Diff compares the tree at root with the tree at otherRoot in other, only descending
+// into directories whose hashes differ.
+func (f *GormFs) Diff(root string, other *GormFs, otherRoot string) ([]Difference, error) {
+	diffs := []Difference{}
+	if err := f.diff(filepath.Clean(root), other, filepath.Clean(otherRoot), "", &diffs); err != nil {
+		return nil, err
+	}
+	return diffs, nil
+}
+
+func (f *GormFs) diff(dir string, other *GormFs, otherDir string, prefix string, diffs *[]Difference) error {
+	here, err := f.hashedChildren(dir)
+	if err != nil {
+		return err
+	}
+	there, err := other.hashedChildren(otherDir)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(here)+len(there))
+	for name := range here {
+		names = append(names, name)
+	}
+	for name := range there {
+		if _, ok := here[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h, inHere := here[name]
+		t, inThere := there[name]
+		path := prefix + name
+		switch {
+		case !inThere:
+			*diffs = append(*diffs, Difference{Kind: DiffRemoved, Path: path, IsDir: h.IsDir})
+		case !inHere:
+			*diffs = append(*diffs, Difference{Kind: DiffAdded, Path: path, IsDir: t.IsDir})
+		case bytes.Equal(h.Hash, t.Hash) && h.IsDir == t.IsDir:
+		case h.IsDir && t.IsDir:
+			if err := f.diff(h.Name, other, t.Name, path+"/", diffs); err != nil {
+				return err
+			}
+		default:
+			*diffs = append(*diffs, Difference{Kind: DiffModified, Path: path, IsDir: h.IsDir && t.IsDir})
+		}
+	}
+	return nil
+}
+
+// hashedChildren lists the direct children of dir by base name, with their hashes filled.
+func (f *GormFs) hashedChildren(dir string) (map[string]*File, error) {
+	files := []*File{}
+	if err := childrenOf(f.table(&File{}), dir, f.now()).Omit("data").Find(&files).Error; err != nil {
+		return nil, errors.Wrap(err, "list children")
+	}
+	children := make(map[string]*File, len(files))
+	for _, file := range files {
+		hash, err := f.entryHash(file)
+		if err != nil {
+			return nil, err
+		}
+		file.Hash = hash
+		children[filepath.Base(file.Name)] = file
+	}
+	return children, nil
+}
+
+// entryHash returns the hash of file, storing it unless it changes with the time, see expiringBelow.
+func (f *GormFs) entryHash(file *File) ([]byte, error) {
+	expiring := false
+	if file.IsDir {
+		var err error
+		if expiring, err = f.expiringBelow(file.Name); err != nil {
+			return nil, err
+		}
+	}
+	if file.Hash != nil && !expiring {
+		return file.Hash, nil
+	}
+	hash, err := f.computeHash(file)
+	if err != nil {
+		return nil, err
+	}
+	if f.readOnly || expiring || file.Name == "." || file.Name == "/" { // FIXME: breaks on non-unix
+		return hash, nil
+	}
+
+	_, err = f.updateFile("hash", file.Name, func(latest *File) error {
+		if latest.Hash != nil {
+			hash = latest.Hash
+			return errUnchanged
+		}
+		if latest.Version != file.Version {
+			h, err := f.computeHash(latest)
+			if err != nil {
+				return err
+			}
+			hash = h
+		}
+		latest.Hash = hash
+		return nil
+	}, nil)
+	if err != nil && err != errUnchanged {
+		return nil, errors.Wrap(err, "store hash")
+	}
+	return hash, nil
+}
+
+// expiringBelow reports whether an entry below dir has an expiry, the hash of dir then changing
+// once it is passed without any mutation to clear it.
+func (f *GormFs) expiringBelow(dir string) (bool, error) {
+	var count int64
+	if err := f.table(&File{}).Where("name LIKE ? AND expires_at IS NOT NULL", filepath.Join(dir, "%")).Limit(1).Count(&count).Error; err != nil { // FIXME: support paths with %
+		return false, errors.Wrap(err, "find expiring files")
+	}
+	return count != 0, nil
+}
+
+// computeHash computes the hash of file, see TreeHash.
+func (f *GormFs) computeHash(file *File) ([]byte, error) {
+	if !file.IsDir {
+		data := file.Data
+		if data == nil {
+			full, err := getFile(f.table(&File{}), file.Name, f.now())
+			if err != nil {
+				return nil, err
+			}
+			data = full.Data
+		}
+		return contentHash(data), nil
+	}
+
+	children, err := f.hashedChildren(file.Name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		kind := byte('f')
+		if children[name].IsDir {
+			kind = 'd'
+		}
+		h.Write([]byte(name))
+		h.Write([]byte{0, kind})
+		h.Write(children[name].Hash)
+	}
+	return h.Sum(nil), nil
+}
+
+func contentHash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// invalidateHashes clears the Merkle hashes of the directories above names, bumping their
+// versions so that hashes computed before are not stored.
+func (f *GormFs) invalidateHashes(names ...string) error {
+	dirs := []string{}
+	for _, name := range names {
+		for dir := filepath.Dir(name); dir != "." && dir != "/"; dir = filepath.Dir(dir) { // FIXME: breaks on non-unix
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+	if err := f.table(&File{}).Where("name IN ? AND is_dir = ?", dirs, true).
+		Updates(map[string]interface{}{"hash": nil, "version": gorm.Expr("version + 1")}).Error; err != nil {
+		return errors.Wrap(err, "invalidate directory hashes")
+	}
+	return nil
+}
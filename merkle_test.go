@@ -0,0 +1,98 @@
+package gormfs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeHash(t *testing.T) {
+	a, b := TestingFs(t), TestingFs(t)
+
+	for _, gfs := range []*GormFs{a, b} {
+		require.NoError(t, gfs.MkdirAll("/root/x/y", 0755))
+		require.NoError(t, afero.WriteFile(gfs, "/root/x/y/file", []byte("content"), 0644))
+		require.NoError(t, afero.WriteFile(gfs, "/root/top", []byte("top"), 0644))
+	}
+	// same tree, different location and history
+	require.NoError(t, b.Rename("/root", "/moved"))
+	require.NoError(t, afero.WriteFile(b, "/moved/top", []byte("top"), 0600))
+
+	ha, err := a.TreeHash("/root")
+	require.NoError(t, err)
+	hb, err := b.TreeHash("/moved")
+	require.NoError(t, err)
+	require.Equal(t, ha, hb)
+
+	require.NoError(t, afero.WriteFile(a, "/root/x/y/file", []byte("changed"), 0644))
+	changed, err := a.TreeHash("/root")
+	require.NoError(t, err)
+	require.NotEqual(t, ha, changed)
+
+	require.NoError(t, afero.WriteFile(a, "/root/x/y/file", []byte("content"), 0644))
+	restored, err := a.TreeHash("/root")
+	require.NoError(t, err)
+	require.Equal(t, ha, restored)
+}
+
+func TestDiff(t *testing.T) {
+	a, b := TestingFs(t), TestingFs(t)
+
+	for _, gfs := range []*GormFs{a, b} {
+		require.NoError(t, gfs.MkdirAll("/same/deep", 0755))
+		require.NoError(t, gfs.MkdirAll("/changed/deep", 0755))
+		require.NoError(t, afero.WriteFile(gfs, "/same/deep/file", []byte("same"), 0644))
+		require.NoError(t, afero.WriteFile(gfs, "/changed/deep/file", []byte("v1"), 0644))
+	}
+	require.NoError(t, afero.WriteFile(b, "/changed/deep/file", []byte("v2"), 0644))
+	require.NoError(t, afero.WriteFile(a, "/changed/only-a", nil, 0644))
+	require.NoError(t, b.Mkdir("/only-b", 0755))
+
+	diffs, err := a.Diff("/", b, "/")
+	require.NoError(t, err)
+	require.Equal(t, []Difference{
+		{Kind: DiffModified, Path: "changed/deep/file"},
+		{Kind: DiffRemoved, Path: "changed/only-a"},
+		{Kind: DiffAdded, Path: "only-b", IsDir: true},
+	}, diffs)
+
+	diffs, err = a.Diff("/same", b, "/same")
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+}
+
+func TestDiffExpired(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	a, err := NewGormFs(testingDB(t), WithClock(clock))
+	require.NoError(t, err)
+	b, err := NewGormFs(testingDB(t), WithClock(clock))
+	require.NoError(t, err)
+	for _, gfs := range []*GormFs{a, b} {
+		require.NoError(t, gfs.Mkdir("/d", 0755))
+		require.NoError(t, afero.WriteFile(gfs, "/d/x", []byte("x"), 0644))
+	}
+	diffs, err := a.Diff("/", b, "/")
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+	before, err := a.TreeHash("/d")
+	require.NoError(t, err)
+
+	require.NoError(t, a.SetExpiry("/d/x", now.Add(time.Hour)))
+	diffs, err = a.Diff("/", b, "/")
+	require.NoError(t, err)
+	require.Empty(t, diffs, "the expiry is not a difference until it is passed")
+
+	now = now.Add(2 * time.Hour)
+	_, err = a.Stat("/d/x")
+	require.True(t, os.IsNotExist(err))
+	after, err := a.TreeHash("/d")
+	require.NoError(t, err)
+	require.NotEqual(t, before, after)
+	diffs, err = a.Diff("/", b, "/")
+	require.NoError(t, err)
+	require.Equal(t, []Difference{{Kind: DiffAdded, Path: "d/x"}}, diffs)
+}
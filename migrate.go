@@ -0,0 +1,153 @@
+package gormfs
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrSchemaTooNew is returned when opening a database migrated by a newer version of this package.
+	ErrSchemaTooNew = errors.New("database schema is newer than supported")
+	// ErrSchemaOutdated is returned by MigrateVerify when the database needs to be migrated.
+	ErrSchemaOutdated = errors.New("database schema is outdated")
+)
+
+// SchemaMigration is a row of the schema_migrations table, one per applied migration.
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+type migration struct {
+	name string
+	up   func(f *GormFs, tx *gorm.DB) error
+}
+
+// migrations are applied in order, the schema version being the number of applied migrations.
+// New tables and columns are created by AutoMigrate before they run, migrations only have to
+// move data around. Never reorder or remove them.
+var migrations = []migration{
+	{"number file versions", numberFileVersions},
+	{"compute file checksums", computeFileChecksums},
+}
+
+// SchemaVersion returns the version of the schema of the database.
+func (f *GormFs) SchemaVersion() (int, error) {
+	var version int
+	if err := f.table(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error; err != nil {
+		return 0, errors.Wrap(err, "read schema version")
+	}
+	return version, nil
+}
+
+// prepareSchema migrates or verifies the schema according to the migration mode of f.
+func (f *GormFs) prepareSchema() error {
+	switch f.migration {
+	case MigrateVerify:
+		return f.verifySchema()
+	case MigrateSkip:
+		return nil
+	default:
+		if f.readOnly {
+			return nil
+		}
+		return f.migrate()
+	}
+}
+
+// verifySchema checks that every table exists and every migration was applied, without modifying the database.
+func (f *GormFs) verifySchema() error {
+	for _, model := range allModels {
+		if table := f.tableName(model); !f.db.Migrator().HasTable(table) {
+			return errors.Wrapf(ErrSchemaOutdated, "missing table %s", table)
+		}
+	}
+	version, err := f.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return errors.Wrapf(ErrSchemaTooNew, "version %d, supported %d", version, len(migrations))
+	}
+	if version < len(migrations) {
+		return errors.Wrapf(ErrSchemaOutdated, "version %d, latest %d", version, len(migrations))
+	}
+	return nil
+}
+
+// migrate upgrades the database to the latest schema, each migration in its own transaction.
+func (f *GormFs) migrate() error {
+	if err := f.table(&SchemaMigration{}).AutoMigrate(&SchemaMigration{}); err != nil {
+		return errors.Wrap(err, "migrate db")
+	}
+	version, err := f.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return errors.Wrapf(ErrSchemaTooNew, "version %d, supported %d", version, len(migrations))
+	}
+
+	for _, model := range allModels {
+		migrate := func() error { return f.table(model).AutoMigrate(model) }
+		switch model.(type) {
+		case *File, *TrashedFile:
+			if f.customColumns() {
+				migrate = func() error { return f.migrateTable(model) }
+			}
+		}
+		if err := migrate(); err != nil {
+			return errors.Wrap(err, "migrate db")
+		}
+	}
+	if err := f.createIndexes(&File{}, f.schema.Indexes); err != nil {
+		return errors.Wrap(err, "migrate db")
+	}
+	if err := f.createIndexes(&AuditEntry{}, auditIndexes); err != nil {
+		return errors.Wrap(err, "migrate db")
+	}
+
+	for i := version; i < len(migrations); i++ {
+		m := migrations[i]
+		err := f.db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(f, tx); err != nil {
+				return err
+			}
+			return tx.Table(f.tableName(&SchemaMigration{})).
+				Create(&SchemaMigration{Version: i + 1, Name: m.name, AppliedAt: f.now()}).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "migrate db to version %d (%s)", i+1, m.name)
+		}
+	}
+	return nil
+}
+
+// numberFileVersions gives a creation-time based version to the rows created before versions existed.
+func numberFileVersions(f *GormFs, tx *gorm.DB) error {
+	return tx.Table(f.tableName(&File{})).Where("version = ?", 0).Update("version", uint64(time.Now().UnixNano())).Error
+}
+
+// computeFileChecksums fills the checksum of the files created before checksums were stored on creation.
+func computeFileChecksums(f *GormFs, tx *gorm.DB) error {
+	last := ""
+	for {
+		files := []*File{}
+		if err := tx.Table(f.tableName(&File{})).Where("name > ? AND is_dir = ? AND hash IS NULL", last, false).
+			Order("name").Limit(100).Find(&files).Error; err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := tx.Table(f.tableName(&File{})).Where("name = ?", file.Name).Update("hash", contentHash(file.Data)).Error; err != nil {
+				return err
+			}
+		}
+		if len(files) < 100 {
+			return nil
+		}
+		last = files[len(files)-1].Name
+	}
+}
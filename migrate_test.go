@@ -0,0 +1,52 @@
+package gormfs
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	gfs := TestingFs(t)
+	version, err := gfs.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, len(migrations), version)
+
+	// opening again applies nothing
+	_, err = NewGormFs(gfs.db)
+	require.NoError(t, err)
+	var count int64
+	require.NoError(t, gfs.table(&SchemaMigration{}).Count(&count).Error)
+	require.Equal(t, int64(len(migrations)), count)
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("content"), 0644))
+
+	// as written before versions and checksums existed
+	require.NoError(t, gfs.table(&File{}).Where("name = ?", "/file").
+		Updates(map[string]interface{}{"version": 0, "hash": nil}).Error)
+	require.NoError(t, gfs.db.Migrator().DropTable(&SchemaMigration{}))
+
+	gfs, err := NewGormFs(gfs.db)
+	require.NoError(t, err)
+	version, err := gfs.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, len(migrations), version)
+
+	file, err := getFile(gfs.table(&File{}), "/file", gfs.now())
+	require.NoError(t, err)
+	require.NotZero(t, file.Version)
+	require.Equal(t, contentHash([]byte("content")), file.Hash)
+}
+
+func TestRefuseNewerSchema(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.table(&SchemaMigration{}).Create(&SchemaMigration{Version: len(migrations) + 1}).Error)
+
+	_, err := NewGormFs(gfs.db)
+	require.Equal(t, ErrSchemaTooNew, errors.Cause(err))
+}
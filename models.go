@@ -3,6 +3,8 @@ package gormfs
 import (
 	"io/fs"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type File struct {
@@ -14,6 +16,25 @@ type File struct {
 	User  int
 	Group int
 	Data  []byte
+	// Hash is the SHA-256 of Data for files and the Merkle hash of directories, see TreeHash.
+	// It is nil when not computed yet.
+	Hash []byte
+	// Version is incremented by every update, which only succeeds if the row still has
+	// the version it was read with, see updateFile. It starts from the creation time so
+	// that a removed and recreated entry gets a different version.
+	Version uint64 `gorm:"not null;default:0"`
+	// ExpiresAt hides the entry once passed, until it is deleted by PurgeExpired.
+	ExpiresAt *time.Time
+}
+
+func (file *File) BeforeCreate(tx *gorm.DB) error {
+	if file.Version == 0 {
+		file.Version = uint64(time.Now().UnixNano())
+	}
+	if !file.IsDir && file.Hash == nil {
+		file.Hash = contentHash(file.Data)
+	}
+	return nil
 }
 
-var allModels = []interface{}{&File{}}
+var allModels = []interface{}{&SchemaMigration{}, &File{}, &Change{}, &JournalEntry{}, &ReplicaState{}, &ReplicaVersion{}, &TreeQuota{}, &UserQuota{}, &FileLock{}, &TrashBatch{}, &TrashedFile{}, &AuditEntry{}}
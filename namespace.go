@@ -0,0 +1,180 @@
+package gormfs
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidNamespace  = errors.New("invalid namespace")
+	ErrNamespaceExist    = errors.New("namespace already exists")
+	ErrNamespaceNotExist = errors.New("namespace does not exist")
+)
+
+// namespaceRegexp matches the namespace names, single underscores only separating words so that
+// the tables of a namespace, prefixed with its name and namespaceSeparator, are its own.
+var namespaceRegexp = regexp.MustCompile(`^[a-zA-Z0-9]+(_[a-zA-Z0-9]+)*$`)
+
+const (
+	namespaceSeparator = "__"
+	maxNamespaceLen    = 32
+)
+
+func validNamespace(name string) bool {
+	return len(name) <= maxNamespaceLen && namespaceRegexp.MatchString(name)
+}
+
+// Namespace is a row of the namespace registry. Every namespace stores its
+// filesystem in its own set of tables, prefixed with the namespace name.
+type Namespace struct {
+	Name      string `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+// CreateNamespace registers a new namespace in db, creates its tables and returns its filesystem.
+// The tables are created whatever the migration mode of opts.
+func CreateNamespace(db *gorm.DB, name string, opts ...Option) (*GormFs, error) {
+	if !validNamespace(name) {
+		return nil, errors.Wrap(ErrInvalidNamespace, name)
+	}
+	f := &GormFs{db: db, namespace: name}
+	f.applyOptions(opts)
+	if err := f.migrateRegistry(); err != nil {
+		return nil, err
+	}
+	for _, model := range allModels {
+		if table := f.tableName(model); f.db.Migrator().HasTable(table) {
+			return nil, errors.Wrapf(ErrNamespaceExist, "%s: table %s already exists", name, table)
+		}
+	}
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Table(f.registryName()).Where("name = ?", name).Limit(1).Find(&Namespace{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 0 {
+			return errors.Wrap(ErrNamespaceExist, name)
+		}
+		return tx.Table(f.registryName()).Create(&Namespace{Name: name}).Error
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "register namespace")
+	}
+	if err := f.migrate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenNamespace returns the filesystem of an existing namespace.
+func OpenNamespace(db *gorm.DB, name string, opts ...Option) (*GormFs, error) {
+	if !validNamespace(name) {
+		return nil, errors.Wrap(ErrInvalidNamespace, name)
+	}
+	f := &GormFs{db: db, namespace: name}
+	f.applyOptions(opts)
+	if !f.readOnly {
+		if err := f.migrateRegistry(); err != nil {
+			return nil, err
+		}
+	}
+	res := f.registry().Where("name = ?", name).Limit(1).Find(&Namespace{})
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "find namespace")
+	}
+	if res.RowsAffected == 0 {
+		return nil, errors.Wrap(ErrNamespaceNotExist, name)
+	}
+	if err := f.prepareSchema(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Namespaces lists the namespaces registered in db, sorted by name.
+// The default namespace used by NewGormFs is not listed.
+// opts must carry the same table prefix as the one used to create them.
+func Namespaces(db *gorm.DB, opts ...Option) ([]string, error) {
+	f := &GormFs{db: db}
+	f.applyOptions(opts)
+	names := []string{}
+	if f.readOnly {
+		if !f.db.Migrator().HasTable(f.registryName()) {
+			return names, nil
+		}
+	} else if err := f.migrateRegistry(); err != nil {
+		return nil, err
+	}
+	if err := f.registry().Order("name").Pluck("name", &names).Error; err != nil {
+		return nil, errors.Wrap(err, "list namespaces")
+	}
+	return names, nil
+}
+
+// DropNamespace deletes the tables of a namespace and unregisters it.
+// opts must carry the same table prefix as the one used to create it.
+// Filesystems opened on it must not be used afterwards.
+func DropNamespace(db *gorm.DB, name string, opts ...Option) error {
+	if !validNamespace(name) {
+		return errors.Wrap(ErrInvalidNamespace, name)
+	}
+	f := &GormFs{db: db, namespace: name}
+	f.applyOptions(opts)
+	if err := f.writable("dropnamespace", name); err != nil {
+		return err
+	}
+	if err := f.migrateRegistry(); err != nil {
+		return err
+	}
+	res := f.registry().Where("name = ?", name).Delete(&Namespace{})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "unregister namespace")
+	}
+	if res.RowsAffected == 0 {
+		return errors.Wrap(ErrNamespaceNotExist, name)
+	}
+	for _, model := range allModels {
+		if err := f.db.Migrator().DropTable(f.tableName(model)); err != nil {
+			return errors.Wrap(err, "drop namespace table")
+		}
+	}
+	return nil
+}
+
+// registry scopes f.db to the namespace registry. It only carries the table
+// prefix of f, so that every namespace sharing the prefix is listed in it.
+func (f *GormFs) registry() *gorm.DB {
+	return f.db.Table(f.registryName())
+}
+
+func (f *GormFs) registryName() string {
+	registry := &GormFs{db: f.db, schema: f.schema}
+	return registry.tableName(&Namespace{})
+}
+
+func (f *GormFs) migrateRegistry() error {
+	if err := f.registry().AutoMigrate(&Namespace{}); err != nil {
+		return errors.Wrap(err, "migrate namespaces")
+	}
+	return nil
+}
+
+// table scopes f.db to the table of model in the namespace of f.
+func (f *GormFs) table(model interface{}) *gorm.DB {
+	return f.db.Table(f.tableName(model))
+}
+
+func (f *GormFs) tableName(model interface{}) string {
+	stmt := &gorm.Statement{DB: f.db}
+	if err := stmt.Parse(model); err != nil {
+		panic(fmt.Sprintf("gormfs: invalid model %T: %v", model, err))
+	}
+	if f.namespace == "" {
+		return f.schema.TablePrefix + stmt.Schema.Table
+	}
+	return f.schema.TablePrefix + f.namespace + namespaceSeparator + stmt.Schema.Table
+}
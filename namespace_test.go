@@ -0,0 +1,158 @@
+package gormfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaces(t *testing.T) {
+	def := TestingFs(t)
+	db := def.db
+
+	a, err := CreateNamespace(db, "tenant_a")
+	require.NoError(t, err)
+	b, err := CreateNamespace(db, "tenant_b")
+	require.NoError(t, err)
+
+	_, err = CreateNamespace(db, "tenant_a")
+	require.Equal(t, ErrNamespaceExist, errors.Cause(err))
+	_, err = CreateNamespace(db, "bad-name")
+	require.Equal(t, ErrInvalidNamespace, errors.Cause(err))
+	_, err = OpenNamespace(db, "missing")
+	require.Equal(t, ErrNamespaceNotExist, errors.Cause(err))
+
+	require.NoError(t, afero.WriteFile(def, "/shared", []byte("default"), 0644))
+	require.NoError(t, afero.WriteFile(a, "/shared", []byte("a"), 0644))
+	require.NoError(t, a.Mkdir("/only-a", 0755))
+	require.NoError(t, afero.WriteFile(b, "/shared", []byte("b"), 0644))
+
+	for fs, want := range map[*GormFs]string{def: "default", a: "a", b: "b"} {
+		data, err := afero.ReadFile(fs, "/shared")
+		require.NoError(t, err)
+		require.Equal(t, want, string(data))
+	}
+	exists, err := afero.Exists(b, "/only-a")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	reopened, err := OpenNamespace(db, "tenant_a")
+	require.NoError(t, err)
+	data, err := afero.ReadFile(reopened, "/shared")
+	require.NoError(t, err)
+	require.Equal(t, "a", string(data))
+
+	names, err := Namespaces(db)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant_a", "tenant_b"}, names)
+
+	require.NoError(t, DropNamespace(db, "tenant_a"))
+	require.Equal(t, ErrNamespaceNotExist, errors.Cause(DropNamespace(db, "tenant_a")))
+	names, err = Namespaces(db)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant_b"}, names)
+	require.False(t, db.Migrator().HasTable("tenant_a__files"))
+
+	data, err = afero.ReadFile(b, "/shared")
+	require.NoError(t, err)
+	require.Equal(t, "b", string(data))
+}
+
+func TestNamespaceWatchIsolation(t *testing.T) {
+	def := TestingFs(t)
+	a, err := CreateNamespace(def.db, "tenant_a")
+	require.NoError(t, err)
+
+	w, err := def.Watch("/", true)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, afero.WriteFile(a, "/other", nil, 0644))
+	require.NoError(t, afero.WriteFile(def, "/mine", nil, 0644))
+
+	select {
+	case ev := <-w.Events():
+		require.Equal(t, "/mine", ev.Name)
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+}
+
+func TestNamespacePrefix(t *testing.T) {
+	db := testingDB(t)
+	prefix := WithSchema(SchemaOptions{TablePrefix: "app_"})
+
+	gfs, err := CreateNamespace(db, "tenant", prefix)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("content"), 0644))
+	require.True(t, db.Migrator().HasTable("app_namespaces"))
+	require.True(t, db.Migrator().HasTable("app_tenant__files"))
+	require.False(t, db.Migrator().HasTable("namespaces"))
+
+	names, err := Namespaces(db, prefix)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant"}, names)
+	names, err = Namespaces(db)
+	require.NoError(t, err)
+	require.Empty(t, names, "each prefix has its own registry")
+
+	require.NoError(t, DropNamespace(db, "tenant", prefix))
+	for _, model := range allModels {
+		require.False(t, db.Migrator().HasTable(gfs.tableName(model)))
+	}
+	_, err = OpenNamespace(db, "tenant", prefix)
+	require.Equal(t, ErrNamespaceNotExist, errors.Cause(err))
+}
+
+func TestNamespaceTablesAreOwn(t *testing.T) {
+	def := TestingFs(t)
+	db := def.db
+
+	_, err := CreateNamespace(db, "a")
+	require.NoError(t, err)
+	b, err := CreateNamespace(db, "a_trashed")
+	require.NoError(t, err)
+	trashed, err := CreateNamespace(db, "trashed")
+	require.NoError(t, err)
+	tables := map[string]bool{}
+	for _, fs := range []*GormFs{def, b, trashed} {
+		for _, model := range allModels {
+			table := fs.tableName(model)
+			require.False(t, tables[table], table)
+			tables[table] = true
+		}
+	}
+
+	for _, name := range []string{"a__b", "a_", "_a", "a-b", strings.Repeat("a", 33)} {
+		_, err = CreateNamespace(db, name)
+		require.Equal(t, ErrInvalidNamespace, errors.Cause(err), name)
+	}
+
+	// a table left over, or used by something else, is never taken over
+	require.NoError(t, db.Exec("CREATE TABLE taken__files (id INTEGER)").Error)
+	_, err = CreateNamespace(db, "taken")
+	require.Equal(t, ErrNamespaceExist, errors.Cause(err))
+	names, err := Namespaces(db)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "a_trashed", "trashed"}, names)
+}
+
+func TestNamespacesReadOnly(t *testing.T) {
+	db := testingDB(t)
+
+	names, err := Namespaces(db, WithReadOnly())
+	require.NoError(t, err)
+	require.Empty(t, names)
+	require.False(t, db.Migrator().HasTable("namespaces"))
+
+	_, err = CreateNamespace(db, "tenant_a")
+	require.NoError(t, err)
+	require.True(t, db.Migrator().HasTable("namespaces"))
+	names, err = Namespaces(db, WithReadOnly())
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant_a"}, names)
+}
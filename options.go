@@ -0,0 +1,106 @@
+package gormfs
+
+import (
+	"io/fs"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Option configures a GormFs, see NewGormFs.
+type Option func(f *GormFs)
+
+// MigrationMode tells what NewGormFs does with the schema of the database.
+type MigrationMode int
+
+const (
+	// MigrateAuto creates the missing tables and columns and runs the pending migrations.
+	MigrateAuto MigrationMode = iota
+	// MigrateVerify fails with ErrSchemaOutdated unless the schema is up to date, without modifying it.
+	MigrateVerify
+	// MigrateSkip trusts the schema to be up to date.
+	MigrateSkip
+)
+
+// WithMigration sets the migration mode, MigrateAuto by default.
+func WithMigration(mode MigrationMode) Option {
+	return func(f *GormFs) {
+		f.migration = mode
+	}
+}
+
+// WithReadOnly refuses every modification with fs.ErrPermission and never migrates the schema,
+// so that the filesystem can be opened by a database user without write access.
+// The schema is still verified with MigrateVerify.
+func WithReadOnly() Option {
+	return func(f *GormFs) {
+		f.readOnly = true
+	}
+}
+
+// WithSchema creates the tables according to opts, see SchemaOptions.
+// Column types only apply to the tables it creates, existing columns are never altered.
+func WithSchema(opts SchemaOptions) Option {
+	return func(f *GormFs) {
+		f.schema = opts
+	}
+}
+
+// WithLogger logs the queries of the filesystem with l instead of the logger of the *gorm.DB.
+func WithLogger(l logger.Interface) Option {
+	return func(f *GormFs) {
+		f.db = f.db.Session(&gorm.Session{Logger: l})
+	}
+}
+
+// WithUmask clears the bits of umask from the permissions given to Mkdir and OpenFile.
+func WithUmask(umask fs.FileMode) Option {
+	return func(f *GormFs) {
+		f.umask = umask & fs.ModePerm
+	}
+}
+
+// WithOwner sets the owner of the created entries, root by default.
+func WithOwner(uid, gid int) Option {
+	return func(f *GormFs) {
+		f.uid = uid
+		f.gid = gid
+	}
+}
+
+// WithClock makes the filesystem take its timestamps and expirations from now instead of
+// time.Now. Lock leases still use time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(f *GormFs) {
+		f.clock = now
+	}
+}
+
+// WithInstrumentation reports the operations, transfers and queries of the filesystem to i,
+// see Recorder.
+func WithInstrumentation(i Instrumentation) Option {
+	return func(f *GormFs) {
+		f.instrumentation = i
+	}
+}
+
+// applyOptions configures f with opts, once f.db is set.
+func (f *GormFs) applyOptions(opts []Option) {
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.instrumentation != nil {
+		f.db = instrumentQueries(f.db, f.instrumentation)
+	}
+	if f.tracer != nil {
+		f.db = traceQueries(f.db, f.tracer)
+	}
+}
+
+func (f *GormFs) now() time.Time {
+	if f.clock == nil {
+		return time.Now()
+	}
+	return f.clock()
+}
@@ -0,0 +1,96 @@
+package gormfs
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func testingDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "fs.db")), &gorm.Config{})
+	require.NoError(t, err)
+	return db
+}
+
+func TestMigrationModes(t *testing.T) {
+	db := testingDB(t)
+
+	_, err := NewGormFs(db, WithMigration(MigrateVerify))
+	require.Equal(t, ErrSchemaOutdated, errors.Cause(err))
+	_, err = NewGormFs(db, WithMigration(MigrateSkip))
+	require.NoError(t, err)
+	require.False(t, db.Migrator().HasTable("files"))
+
+	_, err = NewGormFs(db)
+	require.NoError(t, err)
+	gfs, err := NewGormFs(db, WithMigration(MigrateVerify))
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("ok"), 0644))
+
+	require.NoError(t, db.Delete(&SchemaMigration{}, "version = ?", len(migrations)).Error)
+	_, err = NewGormFs(db, WithMigration(MigrateVerify))
+	require.Equal(t, ErrSchemaOutdated, errors.Cause(err))
+}
+
+func TestOwnerUmaskClock(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	gfs, err := NewGormFs(testingDB(t), WithOwner(1000, 100), WithUmask(0022), WithClock(func() time.Time { return now }))
+	require.NoError(t, err)
+
+	require.NoError(t, gfs.Mkdir("/dir", 0777))
+	require.NoError(t, afero.WriteFile(gfs, "/dir/file", []byte("content"), 0666))
+	f, err := gfs.Create("/created")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for name, mode := range map[string]string{"/dir": "drwxr-xr-x", "/dir/file": "-rw-r--r--", "/created": "----------"} {
+		file, err := getFile(gfs.table(&File{}), name, gfs.now())
+		require.NoError(t, err)
+		require.Equal(t, mode, file.Mode.String(), name)
+		require.Equal(t, 1000, file.User, name)
+		require.Equal(t, 100, file.Group, name)
+	}
+	info, err := gfs.Stat("/dir/file")
+	require.NoError(t, err)
+	require.True(t, now.Equal(info.ModTime()))
+}
+
+func TestLoggerAndCacheOptions(t *testing.T) {
+	db := testingDB(t)
+	plain, err := NewGormFs(db)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	l := logger.New(log.New(&buf, "", 0), logger.Config{LogLevel: logger.Info})
+	gfs, err := NewGormFs(db, WithLogger(l), WithCache(1<<20, time.Minute), WithChunkSize(4096))
+	require.NoError(t, err)
+
+	w, err := plain.Watch("/", true)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("content"), 0644))
+	require.Contains(t, buf.String(), "INSERT INTO `files`")
+	select {
+	case <-w.Events():
+	case <-time.After(time.Second):
+		t.Fatal("filesystems sharing a db share their events")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := afero.ReadFile(gfs, "/file")
+		require.NoError(t, err)
+	}
+	require.NotZero(t, gfs.CacheStats().Hits)
+	require.Equal(t, 4096, gfs.readAhead)
+}
@@ -0,0 +1,59 @@
+// Package prometheus exposes the statistics of a gormfs.Recorder as Prometheus metrics.
+package prometheus
+
+import (
+	"github.com/berty/gormfs"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects the statistics of a gormfs.Recorder, typically passed to gormfs.WithInstrumentation.
+type Collector struct {
+	recorder *gormfs.Recorder
+
+	operations   *prom.Desc
+	errors       *prom.Desc
+	latency      *prom.Desc
+	bytesRead    *prom.Desc
+	bytesWritten *prom.Desc
+	queries      *prom.Desc
+}
+
+var _ prom.Collector = (*Collector)(nil)
+
+// NewCollector returns a collector of the statistics of recorder, with constLabels added to every metric.
+func NewCollector(recorder *gormfs.Recorder, constLabels prom.Labels) *Collector {
+	return &Collector{
+		recorder:     recorder,
+		operations:   prom.NewDesc("gormfs_operations_total", "Number of filesystem operations.", []string{"op"}, constLabels),
+		errors:       prom.NewDesc("gormfs_operation_errors_total", "Number of filesystem operations that failed.", []string{"op"}, constLabels),
+		latency:      prom.NewDesc("gormfs_operation_duration_seconds", "Latency of filesystem operations.", []string{"op"}, constLabels),
+		bytesRead:    prom.NewDesc("gormfs_read_bytes_total", "Bytes read through files.", nil, constLabels),
+		bytesWritten: prom.NewDesc("gormfs_written_bytes_total", "Bytes written through files.", nil, constLabels),
+		queries:      prom.NewDesc("gormfs_queries_total", "Number of SQL queries.", nil, constLabels),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	ch <- c.operations
+	ch <- c.errors
+	ch <- c.latency
+	ch <- c.bytesRead
+	ch <- c.bytesWritten
+	ch <- c.queries
+}
+
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	stats := c.recorder.Stats()
+	for op, s := range stats.Ops {
+		ch <- prom.MustNewConstMetric(c.operations, prom.CounterValue, float64(s.Count), op)
+		ch <- prom.MustNewConstMetric(c.errors, prom.CounterValue, float64(s.Errors), op)
+		buckets := make(map[float64]uint64, len(s.Buckets))
+		for i, count := range s.Buckets {
+			buckets[gormfs.LatencyBuckets[i].Seconds()] = count
+		}
+		ch <- prom.MustNewConstHistogram(c.latency, s.Count, s.Latency.Seconds(), buckets, op)
+	}
+	ch <- prom.MustNewConstMetric(c.bytesRead, prom.CounterValue, float64(stats.BytesRead))
+	ch <- prom.MustNewConstMetric(c.bytesWritten, prom.CounterValue, float64(stats.BytesWritten))
+	ch <- prom.MustNewConstMetric(c.queries, prom.CounterValue, float64(stats.Queries))
+}
@@ -0,0 +1,54 @@
+package prometheus
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/berty/gormfs"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestCollector(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "fs.db")), &gorm.Config{})
+	require.NoError(t, err)
+	recorder := gormfs.NewRecorder()
+	gfs, err := gormfs.NewGormFs(db, gormfs.WithInstrumentation(recorder))
+	require.NoError(t, err)
+
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("hello"), 0644))
+	_, err = gfs.Stat("/missing")
+	require.Error(t, err)
+
+	reg := prom.NewPedanticRegistry()
+	require.NoError(t, reg.Register(NewCollector(recorder, prom.Labels{"fs": "test"})))
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP gormfs_operation_errors_total Number of filesystem operations that failed.
+# TYPE gormfs_operation_errors_total counter
+gormfs_operation_errors_total{fs="test",op="close"} 0
+gormfs_operation_errors_total{fs="test",op="openfile"} 0
+gormfs_operation_errors_total{fs="test",op="stat"} 1
+gormfs_operation_errors_total{fs="test",op="truncate"} 0
+gormfs_operation_errors_total{fs="test",op="write"} 0
+# HELP gormfs_operations_total Number of filesystem operations.
+# TYPE gormfs_operations_total counter
+gormfs_operations_total{fs="test",op="close"} 1
+gormfs_operations_total{fs="test",op="openfile"} 1
+gormfs_operations_total{fs="test",op="stat"} 1
+gormfs_operations_total{fs="test",op="truncate"} 1
+gormfs_operations_total{fs="test",op="write"} 1
+# HELP gormfs_written_bytes_total Bytes written through files.
+# TYPE gormfs_written_bytes_total counter
+gormfs_written_bytes_total{fs="test"} 5
+`), "gormfs_operations_total", "gormfs_operation_errors_total", "gormfs_written_bytes_total"))
+
+	count, err := testutil.GatherAndCount(reg, "gormfs_operation_duration_seconds", "gormfs_queries_total")
+	require.NoError(t, err)
+	require.Equal(t, 6, count)
+}
@@ -0,0 +1,145 @@
+package gormfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrQuotaExceeded is wrapped in the *fs.PathError returned by operations refused by a quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaLimit bounds the size and number of regular files, zero means unlimited.
+type QuotaLimit struct {
+	MaxBytes int64
+	MaxFiles int64
+}
+
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+// TreeQuota limits the files below Path.
+type TreeQuota struct {
+	Path string `gorm:"primaryKey"`
+	QuotaLimit
+}
+
+// UserQuota limits the files owned by User.
+type UserQuota struct {
+	User int `gorm:"primaryKey;autoIncrement:false"`
+	QuotaLimit
+}
+
+// SetTreeQuota limits the files below dir, a zero limit removes the quota.
+func (f *GormFs) SetTreeQuota(dir string, limit QuotaLimit) error {
+	if err := f.writable("quota", dir); err != nil {
+		return err
+	}
+	quota := &TreeQuota{Path: filepath.Clean(dir), QuotaLimit: limit}
+	if limit == (QuotaLimit{}) {
+		return f.table(&TreeQuota{}).Delete(quota).Error
+	}
+	return f.table(&TreeQuota{}).Clauses(clause.OnConflict{UpdateAll: true}).Create(quota).Error
+}
+
+// SetUserQuota limits the files owned by uid, a zero limit removes the quota.
+func (f *GormFs) SetUserQuota(uid int, limit QuotaLimit) error {
+	if err := f.writable("quota", "/"); err != nil {
+		return err
+	}
+	quota := &UserQuota{User: uid, QuotaLimit: limit}
+	if limit == (QuotaLimit{}) {
+		return f.table(&UserQuota{}).Delete(quota).Error
+	}
+	return f.table(&UserQuota{}).Clauses(clause.OnConflict{UpdateAll: true}).Create(quota).Error
+}
+
+// TreeUsage returns the size and number of regular files below dir.
+func (f *GormFs) TreeUsage(dir string) (Usage, error) {
+	return usage(descendants(f.table(&File{}), dir, f.now()))
+}
+
+// UserUsage returns the size and number of regular files owned by uid.
+func (f *GormFs) UserUsage(uid int) (Usage, error) {
+	return usage(f.table(&File{}).Where(map[string]interface{}{"user": uid}))
+}
+
+func usage(scope *gorm.DB) (Usage, error) {
+	u := Usage{}
+	if err := scope.Where("is_dir = ?", false).
+		Select("COALESCE(SUM(LENGTH(data)), 0) AS bytes, COUNT(*) AS files").
+		Scan(&u).Error; err != nil {
+		return Usage{}, errors.Wrap(err, "compute usage")
+	}
+	return u, nil
+}
+
+// allows reports whether u, which grew by bytes and files, is within l. A usage that did not grow
+// is allowed even above l, so that it can shrink.
+func (l QuotaLimit) allows(u Usage, bytes, files int64) bool {
+	return (l.MaxBytes == 0 || bytes <= 0 || u.Bytes <= l.MaxBytes) &&
+		(l.MaxFiles == 0 || files <= 0 || u.Files <= l.MaxFiles)
+}
+
+// checkQuota fails if adding bytes and files to name, owned by uid, exceeded a quota. It runs in
+// the transaction that added them, after the mutation, so that concurrent additions cannot each
+// pass the check and exceed the quota together.
+func (f *GormFs) checkQuota(op, name string, uid int, bytes, files int64) error {
+	if bytes <= 0 && files <= 0 {
+		return nil
+	}
+	if err := f.checkTreeQuota(op, name, bytes, files, ""); err != nil {
+		return err
+	}
+
+	quotas := []UserQuota{}
+	if err := f.table(&UserQuota{}).Where(map[string]interface{}{"user": uid}).Find(&quotas).Error; err != nil {
+		return errors.Wrap(err, "load user quota")
+	}
+	for _, q := range quotas {
+		u, err := f.UserUsage(uid)
+		if err != nil {
+			return err
+		}
+		if !q.allows(u, bytes, files) {
+			return &fs.PathError{Op: op, Path: name, Err: ErrQuotaExceeded}
+		}
+	}
+	return nil
+}
+
+// checkTreeQuota checks the tree quotas above name once bytes and files were added to it,
+// ignoring those that also contain except, see checkQuota.
+func (f *GormFs) checkTreeQuota(op, name string, bytes, files int64, except string) error {
+	scopes := []string{}
+	for dir := filepath.Dir(filepath.Clean(name)); ; dir = filepath.Dir(dir) {
+		scopes = append(scopes, dir)
+		if dir == "." || dir == "/" { // FIXME: breaks on non-unix
+			break
+		}
+	}
+
+	quotas := []TreeQuota{}
+	if err := f.table(&TreeQuota{}).Where("path IN ?", scopes).Find(&quotas).Error; err != nil {
+		return errors.Wrap(err, "load tree quotas")
+	}
+	for _, q := range quotas {
+		if except != "" && (q.Path == "." || strings.HasPrefix(except, strings.TrimSuffix(q.Path, "/")+"/")) {
+			continue
+		}
+		u, err := f.TreeUsage(q.Path)
+		if err != nil {
+			return err
+		}
+		if !q.allows(u, bytes, files) {
+			return &fs.PathError{Op: op, Path: name, Err: ErrQuotaExceeded}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package gormfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeQuota(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.MkdirAll("/limited/sub", 0755))
+	require.NoError(t, gfs.Mkdir("/free", 0755))
+	require.NoError(t, gfs.SetTreeQuota("/limited", QuotaLimit{MaxBytes: 10, MaxFiles: 2}))
+
+	require.NoError(t, afero.WriteFile(gfs, "/limited/sub/a", []byte("12345678"), 0644))
+
+	f, err := gfs.OpenFile("/limited/sub/a", os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("abc"), 8)
+	require.True(t, errors.Is(err, ErrQuotaExceeded), err)
+	// overwriting in place does not grow the file
+	_, err = f.WriteAt([]byte("abc"), 0)
+	require.NoError(t, err)
+	require.True(t, errors.Is(f.Truncate(11), ErrQuotaExceeded))
+	require.NoError(t, f.Truncate(4))
+	require.NoError(t, f.Close())
+
+	_, err = gfs.Create("/limited/b")
+	require.NoError(t, err)
+	_, err = gfs.Create("/limited/c")
+	require.True(t, errors.Is(err, ErrQuotaExceeded), err)
+	_, err = gfs.Create("/free/c")
+	require.NoError(t, err)
+
+	// moving files in is accounted, moving within the tree is not
+	require.True(t, errors.Is(gfs.Rename("/free/c", "/limited/c"), ErrQuotaExceeded))
+	require.NoError(t, gfs.Rename("/limited/b", "/limited/sub/b"))
+
+	usage, err := gfs.TreeUsage("/limited")
+	require.NoError(t, err)
+	require.Equal(t, Usage{Bytes: 4, Files: 2}, usage)
+
+	require.NoError(t, gfs.SetTreeQuota("/limited", QuotaLimit{}))
+	require.NoError(t, gfs.Rename("/free/c", "/limited/c"))
+}
+
+func TestUserQuota(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, afero.WriteFile(gfs, "/mine", []byte("1234"), 0644))
+	require.NoError(t, gfs.Chown("/mine", 1000, 1000))
+	require.NoError(t, gfs.SetUserQuota(1000, QuotaLimit{MaxBytes: 6}))
+
+	f, err := gfs.OpenFile("/mine", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("56"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("7"))
+	require.True(t, errors.Is(err, ErrQuotaExceeded), err)
+	var pathErr *os.PathError
+	require.True(t, errors.As(err, &pathErr))
+	require.Equal(t, "/mine", pathErr.Path)
+
+	// other users are not limited
+	require.NoError(t, afero.WriteFile(gfs, "/other", []byte("1234567"), 0644))
+
+	usage, err := gfs.UserUsage(1000)
+	require.NoError(t, err)
+	require.Equal(t, Usage{Bytes: 6, Files: 1}, usage)
+}
+
+func TestOwnerQuota(t *testing.T) {
+	db := testingDB(t)
+	gfs, err := NewGormFs(db, WithOwner(1000, 1000))
+	require.NoError(t, err)
+	require.NoError(t, gfs.SetUserQuota(1000, QuotaLimit{MaxFiles: 1}))
+
+	require.NoError(t, afero.WriteFile(gfs, "/first", nil, 0644))
+	_, err = gfs.Create("/second")
+	require.True(t, errors.Is(err, ErrQuotaExceeded), err)
+	_, err = gfs.OpenFile("/third", os.O_CREATE|os.O_WRONLY, 0644)
+	require.True(t, errors.Is(err, ErrQuotaExceeded), err)
+
+	// files created for another owner are not charged to 1000
+	root, err := NewGormFs(db)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(root, "/other", nil, 0644))
+
+	usage, err := gfs.UserUsage(1000)
+	require.NoError(t, err)
+	require.Equal(t, Usage{Files: 1}, usage)
+}
+
+func TestConcurrentQuota(t *testing.T) {
+	gfs := TestingFs(t)
+	require.NoError(t, gfs.Mkdir("/limited", 0755))
+	require.NoError(t, gfs.SetTreeQuota("/limited", QuotaLimit{MaxFiles: 2}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := gfs.Create(fmt.Sprintf("/limited/%d", i))
+			if err == nil {
+				f.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	usage, err := gfs.TreeUsage("/limited")
+	require.NoError(t, err)
+	require.LessOrEqual(t, usage.Files, int64(2))
+}
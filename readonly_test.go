@@ -0,0 +1,109 @@
+package gormfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.db")
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	require.NoError(t, err)
+	rw, err := NewGormFs(db)
+	require.NoError(t, err)
+	require.NoError(t, rw.MkdirAll("/dir/sub", 0755))
+	require.NoError(t, afero.WriteFile(rw, "/dir/file", []byte("content"), 0644))
+
+	// the database itself is opened read-only, so any write, migrations included, would fail
+	roDB, err := gorm.Open(sqlite.Open("file:"+path+"?mode=ro"), &gorm.Config{})
+	require.NoError(t, err)
+	ro, err := NewGormFs(roDB, WithReadOnly())
+	require.NoError(t, err)
+	_, err = NewGormFs(roDB, WithReadOnly(), WithMigration(MigrateVerify))
+	require.NoError(t, err)
+
+	data, err := afero.ReadFile(ro, "/dir/file")
+	require.NoError(t, err)
+	require.Equal(t, "content", string(data))
+	infos, err := afero.ReadDir(ro, "/dir")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	_, err = ro.TreeHash("/dir")
+	require.NoError(t, err)
+
+	denied := map[string]error{}
+	denied["chmod"] = ro.Chmod("/dir/file", 0600)
+	denied["chown"] = ro.Chown("/dir/file", 1, 1)
+	denied["chtimes"] = ro.Chtimes("/dir/file", time.Now(), time.Now())
+	_, denied["create"] = ro.Create("/new")
+	denied["mkdir"] = ro.Mkdir("/new", 0755)
+	denied["mkdirall"] = ro.MkdirAll("/new/dir", 0755)
+	denied["remove"] = ro.Remove("/dir/file")
+	denied["removeall"] = ro.RemoveAll("/dir")
+	denied["rename"] = ro.Rename("/dir/file", "/moved")
+	denied["copy"] = ro.Copy("/dir/file", "/copy")
+	denied["setexpiry"] = ro.SetExpiry("/dir/file", time.Now())
+	_, denied["purgeexpired"] = ro.PurgeExpired(context.Background())
+	_, denied["check"] = ro.Check(context.Background(), true)
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_CREATE, os.O_APPEND | os.O_WRONLY} {
+		_, denied["openfile"] = ro.OpenFile("/dir/file", flag, 0644)
+		require.True(t, errors.Is(denied["openfile"], fs.ErrPermission), "flag %x", flag)
+	}
+	for op, err := range denied {
+		require.True(t, errors.Is(err, fs.ErrPermission), "%s: %v", op, err)
+	}
+
+	f, err := ro.Open("/dir/file")
+	require.NoError(t, err)
+	defer f.Close()
+	require.True(t, errors.Is(f.(Locker).TryLock(LockShared), fs.ErrPermission))
+	_, err = f.Write([]byte("x"))
+	require.Error(t, err)
+
+	report, err := ro.Check(context.Background(), false)
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+}
+
+func TestReadOnlyHandle(t *testing.T) {
+	db := testingDB(t)
+	rw, err := NewGormFs(db)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(rw, "/file", []byte("content"), 0644))
+	ro, err := NewGormFs(db, WithReadOnly())
+	require.NoError(t, err)
+
+	for _, gfs := range []*GormFs{rw, ro} {
+		f, err := gfs.Open("/file")
+		require.NoError(t, err)
+		_, err = f.Write([]byte("x"))
+		require.Error(t, err)
+		_, err = f.WriteAt([]byte("x"), 1)
+		require.Error(t, err)
+		require.Error(t, f.Truncate(0))
+		require.NoError(t, f.Close())
+	}
+
+	// a handle opened for writing is denied once the filesystem is read-only
+	f, err := rw.OpenFile("/file", os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	f.(*aferoFile).fs = ro
+	_, err = f.Write([]byte("x"))
+	require.True(t, errors.Is(err, fs.ErrPermission), err)
+	require.True(t, errors.Is(f.Truncate(0), fs.ErrPermission))
+
+	data, err := afero.ReadFile(rw, "/file")
+	require.NoError(t, err)
+	require.Equal(t, "content", string(data))
+}
@@ -0,0 +1,541 @@
+package gormfs
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm/clause"
+)
+
+// VersionVector counts, per replica, the changes an entry has seen.
+type VersionVector map[string]uint64
+
+const (
+	vvEqual = iota
+	vvBefore
+	vvAfter
+	vvConcurrent
+)
+
+func (v VersionVector) compare(o VersionVector) int {
+	before, after := false, false
+	for id, n := range v {
+		if n > o[id] {
+			after = true
+		} else if n < o[id] {
+			before = true
+		}
+	}
+	for id, n := range o {
+		if _, ok := v[id]; !ok && n > 0 {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return vvConcurrent
+	case before:
+		return vvBefore
+	case after:
+		return vvAfter
+	}
+	return vvEqual
+}
+
+func (v VersionVector) merge(o VersionVector) VersionVector {
+	merged := VersionVector{}
+	for id, n := range v {
+		merged[id] = n
+	}
+	for id, n := range o {
+		if n > merged[id] {
+			merged[id] = n
+		}
+	}
+	return merged
+}
+
+func (v VersionVector) String() string {
+	data, _ := json.Marshal(v) // map keys are sorted
+	return string(data)
+}
+
+func (VersionVector) GormDataType() string {
+	return "string"
+}
+
+func (v VersionVector) Value() (driver.Value, error) {
+	return v.String(), nil
+}
+
+func (v *VersionVector) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(data), v)
+	case []byte:
+		return json.Unmarshal(data, v)
+	case nil:
+		*v = nil
+		return nil
+	}
+	return errors.Errorf("cannot scan %T into VersionVector", src)
+}
+
+// ReplicaState holds the identity of the local replica and how far the journal was folded into versions.
+type ReplicaState struct {
+	ID     string `gorm:"primaryKey"`
+	Cursor uint64
+}
+
+// ReplicaVersion is the replication version of an entry, kept after removal as a tombstone.
+type ReplicaVersion struct {
+	Name    string `gorm:"primaryKey"`
+	Clock   VersionVector
+	Origin  string
+	Deleted bool
+}
+
+type replicaEntry struct {
+	Name    string
+	Clock   VersionVector
+	Origin  string
+	Deleted bool
+	IsDir   bool
+}
+
+type replicaHello struct {
+	Replica string
+	Entries []replicaEntry
+}
+
+type replicaWant struct {
+	Names []string
+}
+
+type replicaFile struct {
+	Name  string
+	Mode  fs.FileMode
+	ATime time.Time
+	MTime time.Time
+	IsDir bool
+	User  int
+	Group int
+	Data  []byte
+	// ExpiresAt is the expiry of the entry, see SetExpiry.
+	ExpiresAt *time.Time
+	Done      bool
+}
+
+type replicaPlan struct {
+	// take maps the remote entries to fetch to their local destination.
+	take map[string]string
+	// source maps local names the peer may request to where they live once conflicts are set aside.
+	source   map[string]string
+	renames  [][2]string
+	deletes  []string
+	versions []ReplicaVersion
+}
+
+// ReplicaID returns the identifier of this database in replication, creating it on first use.
+func (f *GormFs) ReplicaID() (string, error) {
+	state, err := f.replicaState()
+	if err != nil {
+		return "", err
+	}
+	return state.ID, nil
+}
+
+// Replicate exchanges changes with a peer running Replicate on the other end of rw, until
+// both filesystems hold the same tree. Concurrent edits are detected with version vectors:
+// the losing version of a file is kept next to the winner with a ".conflict-<replica>" suffix.
+// The journal must be enabled, and must not be compacted past changes that were not replicated yet.
+func (f *GormFs) Replicate(rw io.ReadWriter) error {
+	if err := f.writable("replicate", "/"); err != nil {
+		return err
+	}
+	if !f.journalEnabled {
+		return errors.New("replication requires the journal, see WithJournal")
+	}
+
+	state, err := f.replicaState()
+	if err != nil {
+		return err
+	}
+	if err := f.refreshVersions(state); err != nil {
+		return errors.Wrap(err, "refresh versions")
+	}
+	local, err := f.replicaEntries()
+	if err != nil {
+		return err
+	}
+
+	enc, dec := json.NewEncoder(rw), json.NewDecoder(rw)
+
+	hello := replicaHello{Replica: state.ID}
+	for _, entry := range local {
+		hello.Entries = append(hello.Entries, entry)
+	}
+	sort.Slice(hello.Entries, func(i, j int) bool { return hello.Entries[i].Name < hello.Entries[j].Name })
+	peer := replicaHello{}
+	if err := exchange(enc, dec, hello, &peer); err != nil {
+		return errors.Wrap(err, "exchange manifests")
+	}
+
+	plan := planReplication(local, peer.Entries)
+	rf := f.withOrigin(peer.Replica)
+	for _, rename := range plan.renames {
+		if err := rf.Rename(rename[0], rename[1]); err != nil {
+			return errors.Wrap(err, "set conflicting file aside")
+		}
+	}
+
+	want := replicaWant{}
+	for name := range plan.take {
+		want.Names = append(want.Names, name)
+	}
+	sort.Strings(want.Names)
+	peerWant := replicaWant{}
+	if err := exchange(enc, dec, want, &peerWant); err != nil {
+		return errors.Wrap(err, "exchange wanted files")
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- f.sendReplicaFiles(enc, peerWant.Names, plan.source) }()
+	if err := rf.receiveReplicaFiles(dec, plan.take); err != nil {
+		return err
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	for _, name := range plan.deletes {
+		if err := rf.RemoveAll(name); err != nil {
+			return errors.Wrapf(err, "delete %s", name)
+		}
+	}
+	for _, version := range plan.versions {
+		version := version
+		if err := f.table(&ReplicaVersion{}).Clauses(clause.OnConflict{UpdateAll: true}).Create(&version).Error; err != nil {
+			return errors.Wrap(err, "save version")
+		}
+	}
+	return nil
+}
+
+func planReplication(local map[string]replicaEntry, remote []replicaEntry) *replicaPlan {
+	plan := &replicaPlan{take: map[string]string{}, source: map[string]string{}}
+	addVersion := func(name string, clock VersionVector, origin string, deleted bool) {
+		plan.versions = append(plan.versions, ReplicaVersion{Name: name, Clock: clock, Origin: origin, Deleted: deleted})
+	}
+
+	for _, r := range remote {
+		l, ok := local[r.Name]
+		if !ok {
+			if !r.Deleted {
+				plan.take[r.Name] = r.Name
+			}
+			addVersion(r.Name, r.Clock, r.Origin, r.Deleted)
+			continue
+		}
+
+		switch l.Clock.compare(r.Clock) {
+		case vvEqual, vvAfter:
+		case vvBefore:
+			if r.Deleted && !l.Deleted {
+				plan.deletes = append(plan.deletes, r.Name)
+			} else if !r.Deleted {
+				plan.take[r.Name] = r.Name
+			}
+			addVersion(r.Name, r.Clock, r.Origin, r.Deleted)
+		case vvConcurrent:
+			merged := l.Clock.merge(r.Clock)
+			switch {
+			case l.Deleted && r.Deleted:
+				origin := r.Origin
+				if replicaWins(l, r) {
+					origin = l.Origin
+				}
+				addVersion(r.Name, merged, origin, true)
+			case r.Deleted:
+				addVersion(r.Name, merged, l.Origin, false)
+			case l.Deleted:
+				plan.take[r.Name] = r.Name
+				addVersion(r.Name, merged, r.Origin, false)
+			case l.IsDir && r.IsDir:
+				origin := l.Origin
+				if !replicaWins(l, r) {
+					plan.take[r.Name] = r.Name
+					origin = r.Origin
+				}
+				addVersion(r.Name, merged, origin, false)
+			default:
+				// directories always win over files, otherwise the version vectors pick
+				localWins := replicaWins(l, r)
+				if l.IsDir != r.IsDir {
+					localWins = l.IsDir
+				}
+				winner, loser := r, l
+				if localWins {
+					winner, loser = l, r
+				}
+				conflict := conflictName(r.Name, loser.Origin)
+				if !localWins {
+					plan.renames = append(plan.renames, [2]string{l.Name, conflict})
+					plan.source[l.Name] = conflict
+					plan.take[r.Name] = r.Name
+				} else {
+					plan.take[r.Name] = conflict
+				}
+				addVersion(r.Name, merged, winner.Origin, false)
+				addVersion(conflict, loser.Clock, loser.Origin, false)
+			}
+		}
+	}
+	return plan
+}
+
+// replicaWins deterministically picks between two concurrent versions, both peers agree on the result.
+func replicaWins(a, b replicaEntry) bool {
+	if a.Origin != b.Origin {
+		return a.Origin > b.Origin
+	}
+	return a.Clock.String() > b.Clock.String()
+}
+
+func conflictName(name, origin string) string {
+	return name + ".conflict-" + origin
+}
+
+func (f *GormFs) sendReplicaFiles(enc *json.Encoder, names []string, source map[string]string) error {
+	for _, name := range names {
+		src := name
+		if s, ok := source[name]; ok {
+			src = s
+		}
+		file, err := getFile(f.table(&File{}), src, f.now())
+		if errors.Is(err, fs.ErrNotExist) {
+			// expired since the manifest was sent, the next replication tombstones it
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "load %s", src)
+		}
+		if err := enc.Encode(replicaFile{
+			Name:      name,
+			Mode:      file.Mode,
+			ATime:     file.ATime,
+			MTime:     file.MTime,
+			IsDir:     file.IsDir,
+			User:      file.User,
+			Group:     file.Group,
+			Data:      file.Data,
+			ExpiresAt: file.ExpiresAt,
+		}); err != nil {
+			return errors.Wrapf(err, "send %s", name)
+		}
+	}
+	return enc.Encode(replicaFile{Done: true})
+}
+
+func (f *GormFs) receiveReplicaFiles(dec *json.Decoder, take map[string]string) error {
+	for {
+		msg := replicaFile{}
+		if err := dec.Decode(&msg); err != nil {
+			return errors.Wrap(err, "receive file")
+		}
+		if msg.Done {
+			return nil
+		}
+		dest, ok := take[msg.Name]
+		if !ok {
+			return errors.Errorf("received unexpected file %s", msg.Name)
+		}
+
+		expiring := msg.ExpiresAt != nil
+		if existing, err := getFile(f.table(&File{}), dest, f.now()); err == nil {
+			if existing.IsDir != msg.IsDir {
+				if err := f.RemoveAll(dest); err != nil {
+					return err
+				}
+			}
+			expiring = expiring || existing.ExpiresAt != nil
+		}
+		meta := File{Mode: msg.Mode, ATime: msg.ATime, MTime: msg.MTime, User: msg.User, Group: msg.Group}
+		if err := f.importEntry(dest, meta, msg.Data); err != nil {
+			return errors.Wrapf(err, "apply %s", dest)
+		}
+		if expiring {
+			expiresAt := time.Time{}
+			if msg.ExpiresAt != nil {
+				expiresAt = *msg.ExpiresAt
+			}
+			if err := f.SetExpiry(dest, expiresAt); err != nil {
+				return errors.Wrapf(err, "apply expiry of %s", dest)
+			}
+		}
+	}
+}
+
+// exchange sends out while receiving in, so that both peers can talk at the same time.
+func exchange(enc *json.Encoder, dec *json.Decoder, out, in interface{}) error {
+	errc := make(chan error, 1)
+	go func() { errc <- enc.Encode(out) }()
+	if err := dec.Decode(in); err != nil {
+		return err
+	}
+	return <-errc
+}
+
+func (f *GormFs) withOrigin(origin string) *GormFs {
+	c := *f
+	c.origin = origin
+	return &c
+}
+
+func (f *GormFs) replicaState() (*ReplicaState, error) {
+	states := []*ReplicaState{}
+	if err := f.table(&ReplicaState{}).Limit(1).Find(&states).Error; err != nil {
+		return nil, errors.Wrap(err, "load replica state")
+	}
+	if len(states) > 0 {
+		return states[0], nil
+	}
+
+	if err := f.writable("replicate", "/"); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "generate replica id")
+	}
+	state := &ReplicaState{ID: hex.EncodeToString(id)}
+	if err := f.table(&ReplicaState{}).Create(state).Error; err != nil {
+		return nil, errors.Wrap(err, "save replica state")
+	}
+	return state, nil
+}
+
+// refreshVersions folds local journal entries into the version vectors.
+func (f *GormFs) refreshVersions(state *ReplicaState) error {
+	for {
+		entries, err := f.Journal(state.Cursor, 1000)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			if entry.Origin == "" {
+				if err := f.versionJournalEntry(state.ID, entry); err != nil {
+					return err
+				}
+			}
+			state.Cursor = entry.Seq
+		}
+	}
+
+	// entries created before the journal was enabled
+	names := []string{}
+	if err := f.table(&File{}).
+		Where("name NOT IN (?)", f.table(&ReplicaVersion{}).Select("name")).
+		Pluck("name", &names).Error; err != nil {
+		return errors.Wrap(err, "find unversioned files")
+	}
+	for _, name := range names {
+		if err := f.bumpVersion(state.ID, name, false); err != nil {
+			return err
+		}
+	}
+
+	return f.table(&ReplicaState{}).Clauses(clause.OnConflict{UpdateAll: true}).Create(state).Error
+}
+
+func (f *GormFs) versionJournalEntry(self string, entry JournalEntry) error {
+	switch entry.Op {
+	case JournalRemove, JournalRemoveAll:
+		return f.tombstoneVersions(self, entry.Name)
+	case JournalRename, JournalCopy:
+		if entry.Op == JournalRename {
+			if err := f.tombstoneVersions(self, entry.Name); err != nil {
+				return err
+			}
+		}
+		names := []string{}
+		if err := descendants(f.table(&File{}), entry.NewName, f.now()).Or("name = ?", entry.NewName).Pluck("name", &names).Error; err != nil {
+			return errors.Wrap(err, "find new files")
+		}
+		for _, name := range names {
+			if err := f.bumpVersion(self, name, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return f.bumpVersion(self, entry.Name, false)
+}
+
+func (f *GormFs) tombstoneVersions(self, name string) error {
+	names := []string{}
+	if err := f.table(&ReplicaVersion{}).
+		Where("(name = ? OR name LIKE ?) AND deleted = ?", name, filepath.Join(name, "%"), false).
+		Pluck("name", &names).Error; err != nil {
+		return errors.Wrap(err, "find removed versions")
+	}
+	for _, name := range names {
+		if err := f.bumpVersion(self, name, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *GormFs) bumpVersion(self, name string, deleted bool) error {
+	versions := []*ReplicaVersion{}
+	if err := f.table(&ReplicaVersion{}).Where("name = ?", name).Limit(1).Find(&versions).Error; err != nil {
+		return errors.Wrap(err, "load version")
+	}
+	version := &ReplicaVersion{Name: name}
+	if len(versions) > 0 {
+		version = versions[0]
+	}
+	if version.Clock == nil {
+		version.Clock = VersionVector{}
+	}
+	version.Clock[self]++
+	version.Origin = self
+	version.Deleted = deleted
+	return f.table(&ReplicaVersion{}).Clauses(clause.OnConflict{UpdateAll: true}).Create(version).Error
+}
+
+// replicaEntries returns the manifest of the local entries. The entries that expired, purged
+// or not, are tombstones: they are removed on the peers that did not change them since.
+func (f *GormFs) replicaEntries() (map[string]replicaEntry, error) {
+	versions := []ReplicaVersion{}
+	if err := f.table(&ReplicaVersion{}).Find(&versions).Error; err != nil {
+		return nil, errors.Wrap(err, "list versions")
+	}
+	files := []*File{}
+	if err := liveBelow(f.table(&File{}), "/", f.now()).Select("name", "is_dir").Find(&files).Error; err != nil {
+		return nil, errors.Wrap(err, "list files")
+	}
+	live := make(map[string]*File, len(files))
+	for _, file := range files {
+		live[file.Name] = file
+	}
+
+	entries := make(map[string]replicaEntry, len(versions))
+	for _, v := range versions {
+		file, ok := live[v.Name]
+		entries[v.Name] = replicaEntry{Name: v.Name, Clock: v.Clock, Origin: v.Origin, Deleted: v.Deleted || !ok, IsDir: ok && file.IsDir}
+	}
+	return entries, nil
+}
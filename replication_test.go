@@ -0,0 +1,153 @@
+package gormfs
+
+import (
+	"context"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func replicate(t *testing.T, a, b *GormFs) {
+	t.Helper()
+
+	ca, cb := net.Pipe()
+	defer ca.Close()
+	defer cb.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- b.Replicate(cb) }()
+	require.NoError(t, a.Replicate(ca))
+	require.NoError(t, <-errc)
+}
+
+func treeContents(t *testing.T, gfs *GormFs) map[string]string {
+	t.Helper()
+
+	files := []*File{}
+	require.NoError(t, gfs.db.Find(&files).Error)
+	tree := map[string]string{}
+	for _, f := range files {
+		if f.IsDir {
+			tree[f.Name] = "<dir>"
+		} else {
+			tree[f.Name] = string(f.Data)
+		}
+	}
+	return tree
+}
+
+func TestReplicate(t *testing.T) {
+	a, b := TestingFs(t, WithJournal()), TestingFs(t, WithJournal())
+
+	require.NoError(t, a.MkdirAll("/docs", 0755))
+	require.NoError(t, afero.WriteFile(a, "/docs/a.txt", []byte("from a"), 0644))
+	require.NoError(t, afero.WriteFile(b, "/b.txt", []byte("from b"), 0644))
+	replicate(t, a, b)
+
+	expected := map[string]string{"/docs": "<dir>", "/docs/a.txt": "from a", "/b.txt": "from b"}
+	require.Equal(t, expected, treeContents(t, a))
+	require.Equal(t, expected, treeContents(t, b))
+
+	// sequential edits on both sides propagate, including removals
+	require.NoError(t, afero.WriteFile(b, "/docs/a.txt", []byte("edited by b"), 0644))
+	require.NoError(t, a.Remove("/b.txt"))
+	replicate(t, b, a)
+
+	expected = map[string]string{"/docs": "<dir>", "/docs/a.txt": "edited by b"}
+	require.Equal(t, expected, treeContents(t, a))
+	require.Equal(t, expected, treeContents(t, b))
+
+	require.NoError(t, a.Rename("/docs", "/archive"))
+	replicate(t, a, b)
+	expected = map[string]string{"/archive": "<dir>", "/archive/a.txt": "edited by b"}
+	require.Equal(t, expected, treeContents(t, a))
+	require.Equal(t, expected, treeContents(t, b))
+
+	// nothing left to exchange
+	replicate(t, a, b)
+	require.Equal(t, expected, treeContents(t, b))
+}
+
+func TestReplicateConflict(t *testing.T) {
+	a, b := TestingFs(t, WithJournal()), TestingFs(t, WithJournal())
+
+	require.NoError(t, afero.WriteFile(a, "/file", []byte("base"), 0644))
+	replicate(t, a, b)
+
+	require.NoError(t, afero.WriteFile(a, "/file", []byte("edit a"), 0644))
+	require.NoError(t, afero.WriteFile(b, "/file", []byte("edit b"), 0644))
+	replicate(t, a, b)
+
+	treeA, treeB := treeContents(t, a), treeContents(t, b)
+	require.Equal(t, treeA, treeB)
+	require.Len(t, treeA, 2)
+
+	idA, err := a.ReplicaID()
+	require.NoError(t, err)
+	idB, err := b.ReplicaID()
+	require.NoError(t, err)
+	winner, loser := "edit a", "edit b"
+	conflict := "/file.conflict-" + idB
+	if idB > idA {
+		winner, loser = loser, winner
+		conflict = "/file.conflict-" + idA
+	}
+	require.Equal(t, winner, treeA["/file"])
+	require.Equal(t, loser, treeA[conflict])
+
+	// the resolution is stable
+	replicate(t, b, a)
+	require.Equal(t, treeA, treeContents(t, a))
+	require.Equal(t, treeA, treeContents(t, b))
+
+	names := []string{}
+	for name := range treeA {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	require.Equal(t, "/file", names[0])
+}
+
+func TestReplicateExpiring(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	a, err := NewGormFs(testingDB(t), WithClock(clock), WithJournal())
+	require.NoError(t, err)
+	b, err := NewGormFs(testingDB(t), WithClock(clock), WithJournal())
+	require.NoError(t, err)
+
+	f, err := a.CreateExpiring("/tmp", now.Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	f, err = a.CreateExpiring("/gone", now.Add(time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, afero.WriteFile(a, "/keep", []byte("keep"), 0644))
+	now = now.Add(30 * time.Minute)
+	replicate(t, a, b)
+
+	tmp, err := getFile(b.table(&File{}), "/tmp", b.now())
+	require.NoError(t, err)
+	require.NotNil(t, tmp.ExpiresAt)
+	require.True(t, tmp.ExpiresAt.Equal(now.Add(30*time.Minute)), "the expiry is replicated")
+	_, err = b.Stat("/gone")
+	require.True(t, os.IsNotExist(err), "expired entries are not replicated")
+
+	now = now.Add(time.Hour)
+	_, err = a.PurgeExpired(context.Background())
+	require.NoError(t, err)
+	replicate(t, a, b)
+	replicate(t, b, a)
+	for _, gfs := range []*GormFs{a, b} {
+		_, err = gfs.Stat("/tmp")
+		require.True(t, os.IsNotExist(err))
+		data, err := afero.ReadFile(gfs, "/keep")
+		require.NoError(t, err)
+		require.Equal(t, "keep", string(data))
+	}
+}
@@ -0,0 +1,123 @@
+package gormfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// SchemaOptions adapts the tables of a GormFs to an existing schema.
+// The zero value keeps the GORM defaults.
+type SchemaOptions struct {
+	// TablePrefix is prepended to every table name, before the namespace if any.
+	TablePrefix string
+	// NameSize bounds the length of the name column, which is unbounded when zero.
+	NameSize int
+	// NameCollation is the collation of the name column, e.g. "C" or "utf8mb4_bin".
+	NameCollation string
+	// DataTypes is the type of the content column per dialect, e.g. {"postgres": "bytea", "mysql": "LONGBLOB"}.
+	DataTypes map[string]string
+	// Indexes are created on the files table in addition to its primary key.
+	Indexes []Index
+}
+
+// Index is an index on the columns of the files table, e.g. {Columns: []string{"is_dir"}}.
+type Index struct {
+	Columns []string
+	Unique  bool
+}
+
+// customColumns tells whether the files tables need other column types than the GORM defaults.
+func (f *GormFs) customColumns() bool {
+	return f.schema.NameSize > 0 || f.schema.NameCollation != "" || f.schema.DataTypes[f.db.Dialector.Name()] != ""
+}
+
+// migrateTable creates the table of model, or adds its missing columns, using the column types of f.schema.
+// Unlike AutoMigrate, it never alters existing columns.
+func (f *GormFs) migrateTable(model interface{}) error {
+	stmt := &gorm.Statement{DB: f.db}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	table := f.tableName(model)
+
+	if !f.db.Migrator().HasTable(table) {
+		sql := "CREATE TABLE ? ("
+		values := []interface{}{clause.Table{Name: table}}
+		for _, dbName := range stmt.Schema.DBNames {
+			sql += "? ?,"
+			values = append(values, clause.Column{Name: dbName}, f.columnType(stmt.Schema.FieldsByDBName[dbName]))
+		}
+		sql += "PRIMARY KEY ?)"
+		keys := []interface{}{}
+		for _, field := range stmt.Schema.PrimaryFields {
+			keys = append(keys, clause.Column{Name: field.DBName})
+		}
+		values = append(values, keys)
+		return f.db.Exec(sql, values...).Error
+	}
+
+	for _, dbName := range stmt.Schema.DBNames {
+		if f.db.Migrator().HasColumn(table, dbName) {
+			continue
+		}
+		err := f.db.Exec("ALTER TABLE ? ADD ? ?", clause.Table{Name: table}, clause.Column{Name: dbName}, f.columnType(stmt.Schema.FieldsByDBName[dbName])).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *GormFs) columnType(field *schema.Field) clause.Expr {
+	switch field.DBName {
+	case "name":
+		typ := f.db.Dialector.DataTypeOf(field)
+		if f.schema.NameSize > 0 {
+			typ = fmt.Sprintf("VARCHAR(%d)", f.schema.NameSize)
+			if f.db.Dialector.Name() == "sqlserver" {
+				typ = "N" + typ
+			}
+		}
+		if f.schema.NameCollation != "" {
+			typ += " COLLATE " + f.schema.NameCollation
+		}
+		return clause.Expr{SQL: typ + " NOT NULL"}
+	case "data":
+		if typ := f.schema.DataTypes[f.db.Dialector.Name()]; typ != "" {
+			return clause.Expr{SQL: typ}
+		}
+	}
+	return f.db.Migrator().FullDataTypeOf(field)
+}
+
+// createIndexes creates the missing indexes on the table of model. Unlike the indexes declared
+// in gorm tags, their names include the table name, which keeps them unique across namespaces.
+func (f *GormFs) createIndexes(model interface{}, indexes []Index) error {
+	table := f.tableName(model)
+	for _, idx := range indexes {
+		if len(idx.Columns) == 0 {
+			return errors.New("index without columns")
+		}
+		name := "idx_" + table + "_" + strings.Join(idx.Columns, "_")
+		if f.db.Migrator().HasIndex(table, name) {
+			continue
+		}
+		sql := "CREATE INDEX ? ON ? ?"
+		if idx.Unique {
+			sql = "CREATE UNIQUE INDEX ? ON ? ?"
+		}
+		columns := []interface{}{}
+		for _, column := range idx.Columns {
+			columns = append(columns, clause.Column{Name: column})
+		}
+		if err := f.db.Exec(sql, clause.Column{Name: name}, clause.Table{Name: table}, columns).Error; err != nil {
+			return errors.Wrapf(err, "create index %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package gormfs
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaOptions(t *testing.T) {
+	db := testingDB(t)
+
+	opts := SchemaOptions{
+		TablePrefix:   "app_",
+		NameSize:      255,
+		NameCollation: "NOCASE",
+		DataTypes:     map[string]string{"sqlite": "BLOB", "postgres": "bytea"},
+		Indexes:       []Index{{Columns: []string{"is_dir"}}, {Columns: []string{"user", "group"}}},
+	}
+	gfs, err := NewGormFs(db, WithSchema(opts))
+	require.NoError(t, err)
+	require.Equal(t, "app_files", gfs.tableName(&File{}))
+	require.True(t, db.Migrator().HasTable("app_trashed_files"))
+	require.False(t, db.Migrator().HasTable("files"))
+
+	var ddl string
+	require.NoError(t, db.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", "app_files").Scan(&ddl).Error)
+	require.Contains(t, ddl, "`name` VARCHAR(255) COLLATE NOCASE NOT NULL")
+	require.Contains(t, ddl, "`data` BLOB")
+	require.True(t, db.Migrator().HasIndex("app_files", "idx_app_files_is_dir"))
+	require.True(t, db.Migrator().HasIndex("app_files", "idx_app_files_user_group"))
+
+	require.NoError(t, afero.WriteFile(gfs, "/Hello", []byte("hello"), 0644))
+	data, err := afero.ReadFile(gfs, "/hello")
+	require.NoError(t, err, "names compare with the collation of the name column")
+	require.Equal(t, "hello", string(data))
+
+	reopened, err := NewGormFs(db, WithSchema(opts))
+	require.NoError(t, err)
+	data, err = afero.ReadFile(reopened, "/Hello")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	other, err := NewGormFs(db, WithSchema(SchemaOptions{TablePrefix: "other_"}))
+	require.NoError(t, err)
+	exists, err := afero.Exists(other, "/Hello")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
@@ -0,0 +1,138 @@
+package gormfs
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// Instrumentation observes the operations of a GormFs, see WithInstrumentation.
+// Its methods are called concurrently.
+type Instrumentation interface {
+	// Operation is called once every operation of the filesystem or of its files returned.
+	// Reaching the end of a file is not an error.
+	Operation(op string, latency time.Duration, err error)
+	// Transfer is called with the bytes read or written through files.
+	Transfer(read, written int)
+	// Query is called after every SQL query.
+	Query()
+}
+
+// LatencyBuckets are the upper bounds of the latency histograms of OpStats.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 5 * time.Second,
+}
+
+type OpStats struct {
+	Count  uint64
+	Errors uint64
+	// Latency is the total time spent in the operation.
+	Latency time.Duration
+	// Buckets counts the operations that took at most the bound of LatencyBuckets at the same index.
+	Buckets []uint64
+}
+
+type Stats struct {
+	// Ops are the statistics of every operation by name, e.g. "open", "read" or "rename".
+	Ops          map[string]OpStats
+	BytesRead    uint64
+	BytesWritten uint64
+	Queries      uint64
+}
+
+// Recorder is an Instrumentation keeping statistics in memory.
+type Recorder struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+var _ Instrumentation = (*Recorder)(nil)
+
+func NewRecorder() *Recorder {
+	return &Recorder{stats: Stats{Ops: map[string]OpStats{}}}
+}
+
+func (r *Recorder) Operation(op string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats.Ops[op]
+	if s.Buckets == nil {
+		s.Buckets = make([]uint64, len(LatencyBuckets))
+	}
+	s.Count++
+	if err != nil {
+		s.Errors++
+	}
+	s.Latency += latency
+	for i, bound := range LatencyBuckets {
+		if latency <= bound {
+			s.Buckets[i]++
+		}
+	}
+	r.stats.Ops[op] = s
+}
+
+func (r *Recorder) Transfer(read, written int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.BytesRead += uint64(read)
+	r.stats.BytesWritten += uint64(written)
+}
+
+func (r *Recorder) Query() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Queries++
+}
+
+// Stats returns a copy of the statistics recorded so far.
+func (r *Recorder) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Ops = make(map[string]OpStats, len(r.stats.Ops))
+	for op, s := range r.stats.Ops {
+		s.Buckets = append([]uint64{}, s.Buckets...)
+		stats.Ops[op] = s
+	}
+	return stats
+}
+
+const instrumentationKey = "gormfs:instrumentation"
+
+// instrumentQueries makes every query run through the returned db call i.Query.
+// The callbacks are registered once per *gorm.DB and ignore the queries of other users of db.
+func instrumentQueries(db *gorm.DB, i Instrumentation) *gorm.DB {
+	count := func(tx *gorm.DB) {
+		if i, ok := tx.Get(instrumentationKey); ok {
+			i.(Instrumentation).Query()
+		}
+	}
+	callbacks := db.Callback()
+	for _, p := range []interface {
+		Get(name string) func(*gorm.DB)
+		Register(name string, fn func(*gorm.DB)) error
+	}{callbacks.Create(), callbacks.Query(), callbacks.Update(), callbacks.Delete(), callbacks.Row(), callbacks.Raw()} {
+		if p.Get(instrumentationKey) == nil {
+			_ = p.Register(instrumentationKey, count)
+		}
+	}
+	return db.Set(instrumentationKey, i).Session(&gorm.Session{})
+}
+
+// transfer reports the bytes read or written by the current operation of f.
+func (f *GormFs) transfer(read, written int) {
+	if read+written == 0 {
+		return
+	}
+	if f.instrumentation != nil {
+		f.instrumentation.Transfer(read, written)
+	}
+	if f.span != nil {
+		f.span.SetAttributes(attribute.Int("gormfs.bytes", read+written))
+	}
+}
@@ -0,0 +1,61 @@
+package gormfs
+
+import (
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	db := testingDB(t)
+	plain, err := NewGormFs(db)
+	require.NoError(t, err)
+	recorder := NewRecorder()
+	gfs, err := NewGormFs(db, WithInstrumentation(recorder))
+	require.NoError(t, err)
+	migrations := recorder.Stats().Queries
+	require.NotZero(t, migrations)
+
+	require.NoError(t, gfs.Mkdir("/dir", 0755))
+	f, err := gfs.Create("/dir/file")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("world"), 6)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = gfs.Open("/dir/file")
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+	require.NoError(t, f.Close())
+
+	_, err = gfs.Open("/missing")
+	require.Error(t, err)
+	_, err = afero.ReadDir(gfs, "/dir")
+	require.NoError(t, err)
+	require.NoError(t, gfs.Rename("/dir/file", "/dir/moved"))
+
+	stats := recorder.Stats()
+	require.Equal(t, uint64(11), stats.BytesWritten)
+	require.Equal(t, uint64(11), stats.BytesRead)
+	for op, count := range map[string]uint64{"mkdir": 1, "create": 1, "write": 1, "writeat": 1, "close": 3, "open": 3, "readdir": 1, "rename": 1} {
+		require.Equal(t, count, stats.Ops[op].Count, op)
+	}
+	require.Equal(t, uint64(1), stats.Ops["open"].Errors)
+	require.Zero(t, stats.Ops["read"].Errors, "reaching the end of a file is not an error")
+	require.NotZero(t, stats.Ops["read"].Count)
+	require.NotZero(t, stats.Ops["rename"].Latency)
+	require.Len(t, stats.Ops["rename"].Buckets, len(LatencyBuckets))
+	require.Equal(t, stats.Ops["rename"].Count, stats.Ops["rename"].Buckets[len(LatencyBuckets)-1])
+	require.Greater(t, stats.Queries, migrations)
+
+	// only the queries of the instrumented filesystem are counted
+	queries := stats.Queries
+	require.NoError(t, plain.Mkdir("/other", 0755))
+	require.Equal(t, queries, recorder.Stats().Queries)
+}
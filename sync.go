@@ -0,0 +1,313 @@
+package gormfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// DeletePolicy decides what happens to entries that exist on only one side of a sync.
+type DeletePolicy int
+
+const (
+	// KeepAll copies entries missing on one side from the other, nothing is deleted.
+	KeepAll DeletePolicy = iota
+	// MirrorGorm makes the GormFs tree authoritative: entries it lacks are deleted from the other side.
+	MirrorGorm
+	// MirrorOther makes the other tree authoritative: entries it lacks are deleted from GormFs.
+	MirrorOther
+)
+
+type SyncOp int
+
+const (
+	CopyToGorm SyncOp = iota
+	CopyToOther
+	DeleteFromGorm
+	DeleteFromOther
+	// Conflict is reported when both sides changed and no side can be picked, it is never applied.
+	Conflict
+)
+
+func (op SyncOp) String() string {
+	switch op {
+	case CopyToGorm:
+		return "copy-to-gorm"
+	case CopyToOther:
+		return "copy-to-other"
+	case DeleteFromGorm:
+		return "delete-from-gorm"
+	case DeleteFromOther:
+		return "delete-from-other"
+	case Conflict:
+		return "conflict"
+	}
+	return "unknown"
+}
+
+type SyncAction struct {
+	Op SyncOp
+	// Path is relative to both sync roots, with forward slashes.
+	Path  string
+	IsDir bool
+}
+
+// SyncPlan is the list of actions needed to bring two trees in sync.
+// It can be inspected as a dry-run before being passed to ApplySync.
+type SyncPlan struct {
+	Actions []SyncAction
+
+	root      string
+	other     afero.Fs
+	otherRoot string
+}
+
+type syncEntry struct {
+	Name  string
+	Mode  fs.FileMode
+	MTime time.Time
+	IsDir bool
+	Size  int64
+}
+
+// PlanSync compares the tree at root with the tree at otherRoot in other, using size,
+// modification time and, when those disagree, content hashes. The newest side of a
+// changed file wins.
+func (f *GormFs) PlanSync(root string, other afero.Fs, otherRoot string, policy DeletePolicy) (*SyncPlan, error) {
+	root = filepath.Clean(root)
+	otherRoot = filepath.Clean(otherRoot)
+
+	local, err := f.syncEntries(root)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := otherSyncEntries(other, otherRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(local)+len(remote))
+	for p := range local {
+		paths = append(paths, p)
+	}
+	for p := range remote {
+		if _, ok := local[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	plan := &SyncPlan{root: root, other: other, otherRoot: otherRoot}
+	skipped := ""
+	for _, p := range paths {
+		if skipped != "" && strings.HasPrefix(p, skipped+"/") {
+			continue
+		}
+		l, inLocal := local[p]
+		r, inRemote := remote[p]
+
+		switch {
+		case inLocal && !inRemote:
+			if policy == MirrorOther {
+				plan.Actions = append(plan.Actions, SyncAction{Op: DeleteFromGorm, Path: p, IsDir: l.IsDir})
+				skipped = p
+			} else {
+				plan.Actions = append(plan.Actions, SyncAction{Op: CopyToOther, Path: p, IsDir: l.IsDir})
+			}
+		case !inLocal && inRemote:
+			if policy == MirrorGorm {
+				plan.Actions = append(plan.Actions, SyncAction{Op: DeleteFromOther, Path: p, IsDir: r.IsDir})
+				skipped = p
+			} else {
+				plan.Actions = append(plan.Actions, SyncAction{Op: CopyToGorm, Path: p, IsDir: r.IsDir})
+			}
+		case l.IsDir != r.IsDir:
+			plan.Actions = append(plan.Actions, SyncAction{Op: Conflict, Path: p})
+			skipped = p
+		case l.IsDir:
+		default:
+			op, changed, err := f.compareSyncFiles(l, r, other, filepath.Join(otherRoot, filepath.FromSlash(p)))
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				plan.Actions = append(plan.Actions, SyncAction{Op: op, Path: p})
+			}
+		}
+	}
+	return plan, nil
+}
+
+// ApplySync executes the actions of plan, skipping conflicts.
+func (f *GormFs) ApplySync(plan *SyncPlan) error {
+	for _, action := range plan.Actions {
+		name := filepath.Join(plan.root, filepath.FromSlash(action.Path))
+		otherName := filepath.Join(plan.otherRoot, filepath.FromSlash(action.Path))
+
+		var err error
+		switch action.Op {
+		case CopyToGorm:
+			err = f.syncToGorm(plan.other, otherName, name)
+		case CopyToOther:
+			err = f.syncToOther(name, plan.other, otherName)
+		case DeleteFromGorm:
+			err = f.RemoveAll(name)
+		case DeleteFromOther:
+			err = plan.other.RemoveAll(otherName)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "%s %s", action.Op, action.Path)
+		}
+	}
+	return nil
+}
+
+// Sync plans and applies a sync in one step, returning the applied plan.
+func (f *GormFs) Sync(root string, other afero.Fs, otherRoot string, policy DeletePolicy) (*SyncPlan, error) {
+	plan, err := f.PlanSync(root, other, otherRoot, policy)
+	if err != nil {
+		return nil, err
+	}
+	return plan, f.ApplySync(plan)
+}
+
+func (f *GormFs) syncEntries(root string) (map[string]syncEntry, error) {
+	rows := []syncEntry{}
+	if err := descendants(f.table(&File{}), root, f.now()).
+		Select("name, mode, m_time, is_dir, COALESCE(LENGTH(data), 0) AS size").
+		Find(&rows).Error; err != nil {
+		return nil, errors.Wrap(err, "list files")
+	}
+	entries := make(map[string]syncEntry, len(rows))
+	for _, row := range rows {
+		entries[relativeTo(root, row.Name)] = row
+	}
+	return entries, nil
+}
+
+func otherSyncEntries(other afero.Fs, root string) (map[string]syncEntry, error) {
+	entries := map[string]syncEntry{}
+	if _, err := other.Stat(root); os.IsNotExist(err) {
+		return entries, nil
+	}
+	err := afero.Walk(other, root, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == root || info.Mode()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		entries[filepath.ToSlash(rel)] = syncEntry{
+			Name:  name,
+			Mode:  info.Mode(),
+			MTime: info.ModTime(),
+			IsDir: info.IsDir(),
+			Size:  info.Size(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "walk other tree")
+	}
+	return entries, nil
+}
+
+func (f *GormFs) compareSyncFiles(local, remote syncEntry, other afero.Fs, otherName string) (SyncOp, bool, error) {
+	if local.Size == remote.Size {
+		if local.MTime.Equal(remote.MTime) {
+			return 0, false, nil
+		}
+		same, err := f.sameContent(local.Name, other, otherName)
+		if err != nil || same {
+			return 0, false, err
+		}
+	}
+
+	switch {
+	case local.MTime.After(remote.MTime):
+		return CopyToOther, true, nil
+	case remote.MTime.After(local.MTime):
+		return CopyToGorm, true, nil
+	}
+	return Conflict, true, nil
+}
+
+func (f *GormFs) sameContent(name string, other afero.Fs, otherName string) (bool, error) {
+	sum, err := f.TreeHash(name)
+	if err != nil {
+		return false, err
+	}
+	of, err := other.Open(otherName)
+	if err != nil {
+		return false, err
+	}
+	defer of.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, of); err != nil {
+		return false, err
+	}
+	return bytes.Equal(sum, h.Sum(nil)), nil
+}
+
+func (f *GormFs) syncToGorm(other afero.Fs, otherName, name string) error {
+	info, err := other.Stat(otherName)
+	if err != nil {
+		return err
+	}
+	meta := File{Mode: info.Mode(), MTime: info.ModTime()}
+	if existing, err := getFile(f.table(&File{}), name, f.now()); err == nil {
+		meta.User, meta.Group = existing.User, existing.Group
+	}
+
+	if info.IsDir() {
+		return f.importEntry(name, meta, nil)
+	}
+	of, err := other.Open(otherName)
+	if err != nil {
+		return err
+	}
+	defer of.Close()
+	data, err := readEntry(of, info.Size())
+	if err != nil {
+		return errors.Wrapf(err, "read %s", otherName)
+	}
+	return f.importEntry(name, meta, data)
+}
+
+func (f *GormFs) syncToOther(name string, other afero.Fs, otherName string) error {
+	file, err := getFile(f.table(&File{}), name, f.now())
+	if err != nil {
+		return err
+	}
+
+	if file.IsDir {
+		if err := other.MkdirAll(otherName, file.Mode.Perm()); err != nil {
+			return err
+		}
+	} else {
+		if err := other.MkdirAll(filepath.Dir(otherName), os.ModePerm); err != nil {
+			return err
+		}
+		if err := afero.WriteFile(other, otherName, file.Data, file.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := other.Chmod(otherName, file.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	return other.Chtimes(otherName, file.ATime, file.MTime)
+}
@@ -0,0 +1,92 @@
+package gormfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+	gfs := TestingFs(t)
+	other := afero.NewMemMapFs()
+	old := time.Now().Add(-time.Hour)
+
+	require.NoError(t, gfs.MkdirAll("/tree/dir", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/tree/dir/from-gorm", []byte("gorm"), 0644))
+	require.NoError(t, afero.WriteFile(gfs, "/tree/shared", []byte("stale"), 0644))
+	require.NoError(t, gfs.Chtimes("/tree/shared", old, old))
+
+	require.NoError(t, other.MkdirAll("/work", 0755))
+	require.NoError(t, afero.WriteFile(other, "/work/from-other", []byte("other"), 0600))
+	require.NoError(t, afero.WriteFile(other, "/work/shared", []byte("fresh"), 0644))
+
+	plan, err := gfs.PlanSync("/tree", other, "/work", KeepAll)
+	require.NoError(t, err)
+	require.Equal(t, []SyncAction{
+		{Op: CopyToOther, Path: "dir", IsDir: true},
+		{Op: CopyToOther, Path: "dir/from-gorm"},
+		{Op: CopyToGorm, Path: "from-other"},
+		{Op: CopyToGorm, Path: "shared"},
+	}, plan.Actions)
+
+	// planning is a dry-run
+	_, err = other.Stat("/work/dir")
+	require.Error(t, err)
+
+	require.NoError(t, gfs.ApplySync(plan))
+
+	data, err := afero.ReadFile(other, "/work/dir/from-gorm")
+	require.NoError(t, err)
+	require.Equal(t, "gorm", string(data))
+	data, err = afero.ReadFile(gfs, "/tree/from-other")
+	require.NoError(t, err)
+	require.Equal(t, "other", string(data))
+	data, err = afero.ReadFile(gfs, "/tree/shared")
+	require.NoError(t, err)
+	require.Equal(t, "fresh", string(data))
+
+	plan, err = gfs.PlanSync("/tree", other, "/work", KeepAll)
+	require.NoError(t, err)
+	require.Empty(t, plan.Actions)
+}
+
+func TestSyncSameContentDifferentTimes(t *testing.T) {
+	gfs := TestingFs(t)
+	other := afero.NewMemMapFs()
+
+	require.NoError(t, afero.WriteFile(gfs, "/tree/file", []byte("same"), 0644))
+	require.NoError(t, afero.WriteFile(other, "/work/file", []byte("same"), 0644))
+	require.NoError(t, gfs.Chtimes("/tree/file", time.Unix(0, 0), time.Unix(0, 0)))
+
+	plan, err := gfs.PlanSync("/tree", other, "/work", KeepAll)
+	require.NoError(t, err)
+	require.Empty(t, plan.Actions)
+}
+
+func TestSyncDeletePolicy(t *testing.T) {
+	gfs := TestingFs(t)
+	other := afero.NewMemMapFs()
+
+	require.NoError(t, gfs.Mkdir("/tree", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/tree/kept", []byte("kept"), 0644))
+	require.NoError(t, other.MkdirAll("/work/gone", 0755))
+	require.NoError(t, afero.WriteFile(other, "/work/gone/file", []byte("gone"), 0644))
+
+	plan, err := gfs.Sync("/tree", other, "/work", MirrorGorm)
+	require.NoError(t, err)
+	require.Equal(t, []SyncAction{
+		{Op: DeleteFromOther, Path: "gone", IsDir: true},
+		{Op: CopyToOther, Path: "kept"},
+	}, plan.Actions)
+
+	_, err = other.Stat("/work/gone")
+	require.Error(t, err)
+
+	require.NoError(t, other.Remove("/work/kept"))
+	_, err = gfs.Sync("/tree", other, "/work", MirrorOther)
+	require.NoError(t, err)
+	_, err = gfs.Stat("/tree/kept")
+	require.Error(t, err)
+}
@@ -0,0 +1,164 @@
+package gormfs
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const instrumentationName = "github.com/berty/gormfs"
+
+// WithTracerProvider makes every operation of the filesystem and of its files create a span,
+// parented to the context given to WithContext, with the span of every SQL query it runs below it.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(f *GormFs) {
+		f.tracer = tp.Tracer(instrumentationName)
+	}
+}
+
+// WithContext returns a filesystem whose operations, and those of the files it opens, are done
+// on behalf of ctx: their spans are children of the span of ctx, and their queries use ctx.
+func (f *GormFs) WithContext(ctx context.Context) *GormFs {
+	c := *f
+	c.ctx = ctx
+	c.db = f.db.WithContext(ctx)
+	c.outer = nil
+	return &c
+}
+
+func (f *GormFs) context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+	return f.ctx
+}
+
+// begin starts the operation op of f on paths, the path and then the new path if any. The operation
+// must be done with the returned filesystem, which carries its span, and ended by calling the returned
+// function with its error, which is replaced by the failure to audit the operation if it had none.
+func (f *GormFs) begin(op string, paths ...string) (*GormFs, func(err *error)) {
+	if f.tracer == nil && f.instrumentation == nil && !f.auditEnabled {
+		return f, func(*error) {}
+	}
+	start := time.Now()
+	g := f.auditing(op, paths...)
+	if f.tracer != nil {
+		attrs := []attribute.KeyValue{attribute.String("gormfs.op", op), attribute.String("gormfs.path", paths[0])}
+		if len(paths) > 1 {
+			attrs = append(attrs, attribute.String("gormfs.new_path", paths[1]))
+		}
+		ctx, span := f.tracer.Start(f.context(), "gormfs."+op, trace.WithAttributes(attrs...))
+		g = g.WithContext(ctx)
+		g.span = span
+		g.outer = f.untraced()
+	}
+	return g, func(err *error) {
+		if auditErr := g.audit(*err); *err == nil {
+			*err = auditErr
+		}
+		e := *err
+		if e == io.EOF {
+			e = nil
+		}
+		if f.instrumentation != nil {
+			f.instrumentation.Operation(op, time.Since(start), e)
+		}
+		if g.span != nil {
+			if e != nil {
+				g.span.RecordError(e)
+				g.span.SetStatus(codes.Error, e.Error())
+			}
+			g.span.End()
+		}
+	}
+}
+
+// begin starts the operation op of af. The operation must be done with the returned filesystem,
+// which carries its span, rather than with af.fs, which is shared by the concurrent operations of af.
+// The successful writes of af are audited as a single write, see WithAudit.
+func (af *aferoFile) begin(op string) (*GormFs, func(err *error)) {
+	g, end := af.fs.begin(op, af.name)
+	if g.op == nil || !fileWrites[op] {
+		return g, end
+	}
+	af.mu.Lock()
+	g.op.name = "write"
+	g.op.quiet = true
+	g.op.coalesced = af.audited
+	af.mu.Unlock()
+	return g, func(err *error) {
+		end(err)
+		if g.op.recorded && *err == nil {
+			af.mu.Lock()
+			af.audited = true
+			af.mu.Unlock()
+		}
+	}
+}
+
+// untraced returns the filesystem an operation was started on, for the files it opens
+// to outlive the span of the operation.
+func (f *GormFs) untraced() *GormFs {
+	if f.outer != nil {
+		return f.outer
+	}
+	return f
+}
+
+const (
+	tracerKey = "gormfs:tracer"
+	spanKey   = "gormfs:span"
+)
+
+// traceQueries makes every query run through the returned db create a span below the span
+// of its context. The callbacks are registered once per *gorm.DB and ignore the queries of
+// other users of db.
+func traceQueries(db *gorm.DB, tracer trace.Tracer) *gorm.DB {
+	before := func(tx *gorm.DB) {
+		t, ok := tx.Get(tracerKey)
+		if !ok {
+			return
+		}
+		_, span := t.(trace.Tracer).Start(tx.Statement.Context, "gormfs.query", trace.WithSpanKind(trace.SpanKindClient))
+		tx.InstanceSet(spanKey, span)
+	}
+	after := func(tx *gorm.DB) {
+		s, ok := tx.InstanceGet(spanKey)
+		if !ok {
+			return
+		}
+		span := s.(trace.Span)
+		span.SetAttributes(
+			attribute.String("db.system", tx.Dialector.Name()),
+			attribute.String("db.statement", tx.Statement.SQL.String()),
+			attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+		)
+		if tx.Error != nil && tx.Error != gorm.ErrRecordNotFound {
+			span.RecordError(tx.Error)
+			span.SetStatus(codes.Error, tx.Error.Error())
+		}
+		span.End()
+	}
+
+	callbacks := db.Callback()
+	if callbacks.Query().Get("gormfs:trace_before") == nil {
+		_ = callbacks.Create().Before("*").Register("gormfs:trace_before", before)
+		_ = callbacks.Create().After("*").Register("gormfs:trace_after", after)
+		_ = callbacks.Query().Before("*").Register("gormfs:trace_before", before)
+		_ = callbacks.Query().After("*").Register("gormfs:trace_after", after)
+		_ = callbacks.Update().Before("*").Register("gormfs:trace_before", before)
+		_ = callbacks.Update().After("*").Register("gormfs:trace_after", after)
+		_ = callbacks.Delete().Before("*").Register("gormfs:trace_before", before)
+		_ = callbacks.Delete().After("*").Register("gormfs:trace_after", after)
+		_ = callbacks.Row().Before("*").Register("gormfs:trace_before", before)
+		_ = callbacks.Row().After("*").Register("gormfs:trace_after", after)
+		_ = callbacks.Raw().Before("*").Register("gormfs:trace_before", before)
+		_ = callbacks.Raw().After("*").Register("gormfs:trace_after", after)
+	}
+	return db.Set(tracerKey, tracer).Session(&gorm.Session{})
+}
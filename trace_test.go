@@ -0,0 +1,120 @@
+package gormfs
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	db := testingDB(t)
+	plain, err := NewGormFs(db)
+	require.NoError(t, err)
+	gfs, err := NewGormFs(db, WithTracerProvider(tp))
+	require.NoError(t, err)
+	exporter.Reset()
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	tfs := gfs.WithContext(ctx)
+	f, err := tfs.Create("/file")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = tfs.Stat("/missing")
+	require.Error(t, err)
+	parent.End()
+
+	require.NoError(t, plain.Mkdir("/untraced", 0755))
+
+	spans := exporter.GetSpans()
+	byName := map[string]tracetest.SpanStub{}
+	children := map[string][]string{}
+	names := map[trace.SpanID]string{}
+	for _, span := range spans {
+		names[span.SpanContext.SpanID()] = span.Name
+	}
+	for _, span := range spans {
+		byName[span.Name] = span
+		children[names[span.Parent.SpanID()]] = append(children[names[span.Parent.SpanID()]], span.Name)
+	}
+
+	require.ElementsMatch(t, []string{"gormfs.create", "gormfs.write", "gormfs.close", "gormfs.stat"}, children["request"])
+	require.Contains(t, children["gormfs.create"], "gormfs.query")
+	require.Contains(t, children["gormfs.write"], "gormfs.query")
+	require.Contains(t, children["gormfs.stat"], "gormfs.query")
+	for _, span := range spans {
+		require.Equal(t, parent.SpanContext().TraceID(), span.SpanContext.TraceID(), span.Name)
+	}
+
+	write := byName["gormfs.write"]
+	require.Equal(t, "write", spanAttribute(write, "gormfs.op").AsString())
+	require.Equal(t, "/file", spanAttribute(write, "gormfs.path").AsString())
+	require.Equal(t, int64(5), spanAttribute(write, "gormfs.bytes").AsInt64())
+	require.Equal(t, codes.Error, byName["gormfs.stat"].Status.Code)
+
+	for _, span := range spans {
+		if span.Name == "gormfs.query" && names[span.Parent.SpanID()] == "gormfs.stat" {
+			require.Equal(t, "sqlite", spanAttribute(span, "db.system").AsString())
+			require.Contains(t, spanAttribute(span, "db.statement").AsString(), "`files`")
+		}
+	}
+	for _, span := range spans {
+		require.NotEqual(t, "gormfs.mkdir", span.Name, "filesystems without tracer do not create spans")
+	}
+}
+
+func TestTracingConcurrentReads(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	gfs, err := NewGormFs(testingDB(t), WithTracerProvider(tp), WithInstrumentation(NewRecorder()), WithAudit(), WithVerifyOnRead())
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("0123456789"), 0644))
+	exporter.Reset()
+
+	f, err := gfs.Open("/file")
+	require.NoError(t, err)
+	defer f.Close()
+	const readers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			p := make([]byte, 2)
+			_, err := f.ReadAt(p, off)
+			require.NoError(t, err)
+			require.Equal(t, byte('0'+off), p[0])
+		}(int64(i))
+	}
+	wg.Wait()
+
+	// every read has its own span, below the caller rather than below another read
+	reads := 0
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "gormfs.readat" {
+			reads++
+			require.False(t, span.Parent.IsValid(), "parented to another read")
+		}
+	}
+	require.Equal(t, readers, reads)
+}
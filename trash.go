@@ -0,0 +1,131 @@
+package gormfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TrashBatch is a Remove or RemoveAll call whose entries were moved to the trash.
+type TrashBatch struct {
+	ID        uint64 `gorm:"primaryKey;autoIncrement"`
+	Path      string
+	RemovedAt time.Time
+}
+
+// TrashedFile is an entry removed as part of a TrashBatch.
+type TrashedFile struct {
+	Batch uint64 `gorm:"primaryKey;autoIncrement:false"`
+	File  `gorm:"embedded"`
+}
+
+// WithTrash makes Remove and RemoveAll move entries to the trash, from where they can be
+// restored with Restore until purged with PurgeTrash.
+func WithTrash() Option {
+	return func(f *GormFs) {
+		f.trashEnabled = true
+	}
+}
+
+// Trash lists the trashed batches, oldest first.
+func (f *GormFs) Trash() ([]TrashBatch, error) {
+	batches := []TrashBatch{}
+	if err := f.table(&TrashBatch{}).Order("id").Find(&batches).Error; err != nil {
+		return nil, errors.Wrap(err, "list trash")
+	}
+	return batches, nil
+}
+
+// Restore puts back the entries of a trashed batch, recreating missing parent directories.
+// It fails if the removed path exists again.
+func (f *GormFs) Restore(id uint64) error {
+	if err := f.writable("restore", "/"); err != nil {
+		return err
+	}
+	batches := []TrashBatch{}
+	if err := f.table(&TrashBatch{}).Where("id = ?", id).Limit(1).Find(&batches).Error; err != nil {
+		return errors.Wrap(err, "load trash batch")
+	}
+	if len(batches) == 0 {
+		return errors.Errorf("no trash batch %d", id)
+	}
+	if f.exists(batches[0].Path) {
+		return &fs.PathError{Op: "restore", Path: batches[0].Path, Err: fs.ErrExist}
+	}
+
+	files := []TrashedFile{}
+	if err := f.table(&TrashedFile{}).Where("batch = ?", id).Order("name").Find(&files).Error; err != nil {
+		return errors.Wrap(err, "load trashed files")
+	}
+	for _, file := range files {
+		if err := f.importEntry(file.Name, file.File, file.Data); err != nil {
+			return errors.Wrapf(err, "restore %s", file.Name)
+		}
+	}
+	return f.deleteTrashBatches([]uint64{id})
+}
+
+// PurgeTrash permanently deletes the batches trashed more than retention ago,
+// returning how many were deleted.
+func (f *GormFs) PurgeTrash(retention time.Duration) (int64, error) {
+	if err := f.writable("purge", "/"); err != nil {
+		return 0, err
+	}
+	ids := []uint64{}
+	if err := f.table(&TrashBatch{}).Where("removed_at < ?", f.now().Add(-retention)).Pluck("id", &ids).Error; err != nil {
+		return 0, errors.Wrap(err, "find expired trash")
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return int64(len(ids)), f.deleteTrashBatches(ids)
+}
+
+func (f *GormFs) deleteTrashBatches(ids []uint64) error {
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(f.tableName(&TrashedFile{})).Where("batch IN ?", ids).Delete(&TrashedFile{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(f.tableName(&TrashBatch{})).Where("id IN ?", ids).Delete(&TrashBatch{}).Error
+	})
+	return errors.Wrap(err, "delete trash")
+}
+
+// deleteFiles deletes name, and everything below it when tree is set, moving the
+// deleted rows to the trash when enabled.
+func (f *GormFs) deleteFiles(name string, tree bool) error {
+	where, args := "name = ?", []interface{}{name}
+	if tree {
+		where, args = "name = ? OR name LIKE ?", []interface{}{name, filepath.Join(name, "%")} // FIXME: support paths with %
+	}
+	if !f.trashEnabled {
+		return f.table(&File{}).Where(where, args...).Delete(&File{}).Error
+	}
+
+	stmt := &gorm.Statement{DB: f.db}
+	if err := stmt.Parse(&File{}); err != nil {
+		return errors.Wrap(err, "parse file schema")
+	}
+	columns := strings.Join(fileColumns(stmt), ", ")
+	query := fmt.Sprintf("INSERT INTO %s (batch, %s) SELECT ?, %s FROM %s WHERE %s",
+		stmt.Quote(clause.Table{Name: f.tableName(&TrashedFile{})}), columns, columns,
+		stmt.Quote(clause.Table{Name: f.tableName(&File{})}), where)
+
+	err := f.transaction(func(tx *GormFs) error {
+		batch := &TrashBatch{Path: name, RemovedAt: f.now()}
+		if err := tx.table(&TrashBatch{}).Create(batch).Error; err != nil {
+			return err
+		}
+		if err := tx.db.Exec(query, append([]interface{}{batch.ID}, args...)...).Error; err != nil {
+			return err
+		}
+		return tx.table(&File{}).Where(where, args...).Delete(&File{}).Error
+	})
+	return errors.Wrap(err, "move files to trash")
+}
@@ -0,0 +1,80 @@
+package gormfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrashRestore(t *testing.T) {
+	gfs := TestingFs(t, WithTrash())
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, gfs.MkdirAll("/docs/sub", 0750))
+	require.NoError(t, afero.WriteFile(gfs, "/docs/a", []byte("a"), 0600))
+	require.NoError(t, afero.WriteFile(gfs, "/docs/sub/b", []byte("b"), 0644))
+	require.NoError(t, gfs.Chtimes("/docs/a", mtime, mtime))
+	require.NoError(t, afero.WriteFile(gfs, "/single", []byte("single"), 0644))
+	before := treeContents(t, gfs)
+
+	require.NoError(t, gfs.RemoveAll("/docs"))
+	require.NoError(t, gfs.Remove("/single"))
+	require.Equal(t, map[string]string{}, treeContents(t, gfs))
+
+	batches, err := gfs.Trash()
+	require.NoError(t, err)
+	require.Len(t, batches, 2)
+	require.Equal(t, "/docs", batches[0].Path)
+	require.Equal(t, "/single", batches[1].Path)
+
+	require.NoError(t, gfs.Restore(batches[0].ID))
+	require.NoError(t, gfs.Restore(batches[1].ID))
+	require.Equal(t, before, treeContents(t, gfs))
+	info, err := gfs.Stat("/docs/a")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode())
+	require.True(t, mtime.Equal(info.ModTime()))
+
+	batches, err = gfs.Trash()
+	require.NoError(t, err)
+	require.Empty(t, batches)
+}
+
+func TestTrashRestoreConflict(t *testing.T) {
+	gfs := TestingFs(t, WithTrash())
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("old"), 0644))
+	require.NoError(t, gfs.Remove("/file"))
+	require.NoError(t, afero.WriteFile(gfs, "/file", []byte("new"), 0644))
+
+	batches, err := gfs.Trash()
+	require.NoError(t, err)
+	require.True(t, errors.Is(gfs.Restore(batches[0].ID), os.ErrExist))
+	data, err := afero.ReadFile(gfs, "/file")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+}
+
+func TestPurgeTrash(t *testing.T) {
+	gfs := TestingFs(t, WithTrash())
+	require.NoError(t, afero.WriteFile(gfs, "/old", nil, 0644))
+	require.NoError(t, afero.WriteFile(gfs, "/recent", nil, 0644))
+	require.NoError(t, gfs.Remove("/old"))
+	require.NoError(t, gfs.Remove("/recent"))
+	require.NoError(t, gfs.table(&TrashBatch{}).Where("path = ?", "/old").
+		Update("removed_at", time.Now().Add(-48*time.Hour)).Error)
+
+	n, err := gfs.PurgeTrash(24 * time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	batches, err := gfs.Trash()
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, "/recent", batches[0].Path)
+	var count int64
+	require.NoError(t, gfs.table(&TrashedFile{}).Count(&count).Error)
+	require.Equal(t, int64(1), count)
+}
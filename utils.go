@@ -3,17 +3,20 @@ package gormfs
 import (
 	"io/fs"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
 )
 
-func getFile(db *gorm.DB, name string) (*File, error) {
+// getFile loads name, which does not exist once it or one of its ancestors expired at now.
+func getFile(db *gorm.DB, name string, now time.Time) (*File, error) {
 	name = filepath.Clean(name)
-	if name == "/" || "name" == "." {
+	if name == "/" || name == "." {
 		return &File{Name: name, Mode: fs.ModeDir | 0644, IsDir: true}, nil
 	}
 	var files []*File
-	if err := db.Where("name = ?", name).Limit(1).Find(&files).Error; err != nil {
+	if err := liveAncestors(live(db, now), filepath.Dir(name), now).Where("name = ?", name).Limit(1).Find(&files).Error; err != nil {
 		return nil, err
 	}
 	if len(files) == 0 {
@@ -21,3 +24,65 @@ func getFile(db *gorm.DB, name string) (*File, error) {
 	}
 	return files[0], nil
 }
+
+// descendants scopes db to every entry below root, at any depth, leaving out the expired
+// entries and everything below them.
+func descendants(db *gorm.DB, root string, now time.Time) *gorm.DB {
+	root = filepath.Clean(root)
+	return liveBelow(db, root, now).Where("name LIKE ?", filepath.Join(root, "%")) // FIXME: support paths with %
+}
+
+// subtree scopes db to root and its descendants, see descendants.
+func subtree(db *gorm.DB, root string, now time.Time) *gorm.DB {
+	root = filepath.Clean(root)
+	return liveBelow(db, root, now).Where("(name = ? OR name LIKE ?)", root, filepath.Join(root, "%")) // FIXME: support paths with %
+}
+
+// liveBelow scopes db to the entries that have not expired, and are not below root
+// and an expired entry.
+func liveBelow(db *gorm.DB, root string, now time.Time) *gorm.DB {
+	expired := []string{}
+	if err := db.Session(&gorm.Session{NewDB: true}).Table(db.Statement.Table).
+		Where("name LIKE ? AND expires_at <= ?", filepath.Join(root, "%"), now).Pluck("name", &expired).Error; err != nil {
+		_ = db.AddError(err)
+	}
+	db = liveAncestors(live(db, now), root, now)
+	for _, name := range expired {
+		db = db.Not("name LIKE ?", filepath.Join(name, "%"))
+	}
+	return db
+}
+
+// childrenOf scopes db to the direct children of dir that have not expired.
+func childrenOf(db *gorm.DB, dir string, now time.Time) *gorm.DB {
+	dir = filepath.Clean(dir)
+	return liveAncestors(live(db, now), dir, now).Where("name LIKE ?", filepath.Join(dir, "%")).Not("name LIKE ?", filepath.Join(dir, "%", "%"))
+}
+
+// live scopes db to the entries that have not expired at now.
+func live(db *gorm.DB, now time.Time) *gorm.DB {
+	return db.Where("(expires_at IS NULL OR expires_at > ?)", now)
+}
+
+// liveAncestors scopes db to nothing once dir or one of its ancestors expired at now.
+func liveAncestors(db *gorm.DB, dir string, now time.Time) *gorm.DB {
+	dirs := []string{}
+	for ; dir != "." && dir != "/"; dir = filepath.Dir(dir) { // FIXME: breaks on non-unix
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) == 0 {
+		return db
+	}
+	expired := db.Session(&gorm.Session{NewDB: true}).Table(db.Statement.Table).
+		Select("1").Where("name IN ? AND expires_at <= ?", dirs, now)
+	return db.Where("NOT EXISTS (?)", expired)
+}
+
+// relativeTo returns name relative to root, using forward slashes.
+func relativeTo(root, name string) string {
+	root = filepath.Clean(root)
+	if root == "." || root == "/" { // FIXME: breaks on non-unix
+		return strings.TrimPrefix(name, "/")
+	}
+	return strings.TrimPrefix(name, root+"/")
+}
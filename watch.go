@@ -0,0 +1,238 @@
+package gormfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type Op uint32
+
+const (
+	OpCreate Op = 1 << iota
+	OpWrite
+	OpRemove
+	OpRename
+	OpChmod
+)
+
+func (op Op) String() string {
+	names := []string{}
+	for _, o := range []struct {
+		op   Op
+		name string
+	}{{OpCreate, "CREATE"}, {OpWrite, "WRITE"}, {OpRemove, "REMOVE"}, {OpRename, "RENAME"}, {OpChmod, "CHMOD"}} {
+		if op&o.op != 0 {
+			names = append(names, o.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+type Event struct {
+	Op   Op
+	Name string
+	// OldName is the previous name of a renamed entry.
+	OldName string
+	Time    time.Time
+}
+
+// Change is a row of the change log, see WithChangeLog.
+type Change struct {
+	Seq     uint64 `gorm:"primaryKey;autoIncrement"`
+	Op      Op
+	Name    string
+	OldName string
+	Time    time.Time
+}
+
+// Watcher delivers events for operations done through any GormFs sharing the same *gorm.DB
+// and tables in this process.
+type Watcher struct {
+	name      string
+	recursive bool
+	hub       *hub
+	events    chan Event
+	done      chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []Event
+	closed  bool
+}
+
+// Watch reports changes to name and, for directories, to their direct children.
+// When recursive is set, changes anywhere below name are reported too.
+func (f *GormFs) Watch(name string, recursive bool) (*Watcher, error) {
+	name = filepath.Clean(name)
+	if !f.exists(name) {
+		return nil, &fs.PathError{Op: "watch", Path: name, Err: fs.ErrNotExist}
+	}
+
+	w := &Watcher{name: name, recursive: recursive, events: make(chan Event), done: make(chan struct{})}
+	w.cond = sync.NewCond(&w.mu)
+	w.hub = acquireHub(hubKey{f.db.ConnPool, f.tableName(&File{})}, w)
+	go w.run()
+	return w, nil
+}
+
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.cond.Signal()
+	w.mu.Unlock()
+
+	w.hub.release(w)
+	return nil
+}
+
+func (w *Watcher) matches(name string) bool {
+	if name == w.name {
+		return true
+	}
+	if w.recursive {
+		return w.name == "." || strings.HasPrefix(name, strings.TrimSuffix(w.name, "/")+"/") // FIXME: breaks on non-unix
+	}
+	return filepath.Dir(name) == w.name
+}
+
+func (w *Watcher) push(ev Event) {
+	if !w.matches(ev.Name) && (ev.OldName == "" || !w.matches(ev.OldName)) {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.pending = append(w.pending, ev)
+	w.cond.Signal()
+}
+
+// run forwards queued events so slow consumers never block filesystem operations.
+func (w *Watcher) run() {
+	defer close(w.events)
+	for {
+		w.mu.Lock()
+		for len(w.pending) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		ev := w.pending[0]
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.events <- ev:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+type hubKey struct {
+	// pool is the connection pool of the *gorm.DB, which is shared by its sessions.
+	pool gorm.ConnPool
+	// table is the files table, which differs between namespaces and table prefixes.
+	table string
+}
+
+type hub struct {
+	key      hubKey
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+var (
+	hubsMu sync.Mutex
+	hubs   = map[hubKey]*hub{}
+)
+
+func acquireHub(key hubKey, w *Watcher) *hub {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	h, ok := hubs[key]
+	if !ok {
+		h = &hub{key: key, watchers: map[*Watcher]struct{}{}}
+		hubs[key] = h
+	}
+	h.mu.Lock()
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+	return h
+}
+
+func (h *hub) release(w *Watcher) {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.watchers, w)
+	if len(h.watchers) == 0 {
+		delete(hubs, h.key)
+	}
+}
+
+func (h *hub) dispatch(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		w.push(ev)
+	}
+}
+
+// WithChangeLog records every event in the changes table, so that other processes
+// can poll them with Changes.
+func WithChangeLog() Option {
+	return func(f *GormFs) {
+		f.changeLog = true
+	}
+}
+
+// Changes returns up to limit changes recorded after cursor, oldest first.
+// The Seq of the last returned change is the cursor for the next call.
+func (f *GormFs) Changes(cursor uint64, limit int) ([]Change, error) {
+	changes := []Change{}
+	if err := f.table(&Change{}).Where("seq > ?", cursor).Order("seq").Limit(limit).Find(&changes).Error; err != nil {
+		return nil, errors.Wrap(err, "list changes")
+	}
+	return changes, nil
+}
+
+func (f *GormFs) notify(op Op, name, oldName string) error {
+	ev := Event{Op: op, Name: name, OldName: oldName, Time: f.now()}
+
+	key := hubKey{f.db.ConnPool, f.tableName(&File{})}
+	f.afterCommit(func() {
+		hubsMu.Lock()
+		h := hubs[key]
+		hubsMu.Unlock()
+		if h != nil {
+			h.dispatch(ev)
+		}
+	})
+
+	if f.changeLog {
+		if err := f.table(&Change{}).Create(&Change{Op: op, Name: name, OldName: oldName, Time: ev.Time}).Error; err != nil {
+			return errors.Wrap(err, "record change")
+		}
+	}
+	return nil
+}
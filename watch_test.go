@@ -0,0 +1,88 @@
+package gormfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func nextEvent(t *testing.T, w *Watcher) Event {
+	t.Helper()
+
+	select {
+	case ev := <-w.Events():
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return Event{}
+}
+
+func TestWatch(t *testing.T) {
+	gfs := TestingFs(t)
+	other, err := NewGormFs(gfs.db)
+	require.NoError(t, err)
+
+	require.NoError(t, gfs.MkdirAll("/dir/sub", 0755))
+
+	w, err := gfs.Watch("/dir", false)
+	require.NoError(t, err)
+	defer w.Close()
+	rw, err := gfs.Watch("/dir", true)
+	require.NoError(t, err)
+	defer rw.Close()
+
+	require.NoError(t, afero.WriteFile(other, "/dir/file", []byte("data"), 0644))
+	require.NoError(t, afero.WriteFile(other, "/dir/sub/deep", []byte("data"), 0644))
+	require.NoError(t, other.Chmod("/dir/file", 0600))
+	require.NoError(t, other.Rename("/dir/file", "/dir/renamed"))
+	require.NoError(t, other.Remove("/dir/renamed"))
+
+	for _, expected := range []Event{
+		{Op: OpCreate, Name: "/dir/file"},
+		{Op: OpWrite, Name: "/dir/file"},
+		{Op: OpChmod, Name: "/dir/file"},
+		{Op: OpRename, Name: "/dir/renamed", OldName: "/dir/file"},
+		{Op: OpRemove, Name: "/dir/renamed"},
+	} {
+		ev := nextEvent(t, w)
+		require.Equal(t, expected.Op, ev.Op, ev)
+		require.Equal(t, expected.Name, ev.Name)
+		require.Equal(t, expected.OldName, ev.OldName)
+	}
+
+	names := []string{}
+	for i := 0; i < 7; i++ {
+		names = append(names, nextEvent(t, rw).Name)
+	}
+	require.Contains(t, names, "/dir/sub/deep")
+
+	require.NoError(t, w.Close())
+	_, ok := <-w.Events()
+	require.False(t, ok)
+}
+
+func TestChangeLog(t *testing.T) {
+	gfs := TestingFs(t, WithChangeLog())
+
+	require.NoError(t, gfs.Mkdir("/dir", 0755))
+	require.NoError(t, afero.WriteFile(gfs, "/dir/file", []byte("data"), 0644))
+	require.NoError(t, gfs.RemoveAll("/dir"))
+
+	changes, err := gfs.Changes(0, 3)
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	require.Equal(t, OpCreate, changes[0].Op)
+	require.Equal(t, "/dir", changes[0].Name)
+	require.Equal(t, OpWrite, changes[2].Op)
+
+	changes, err = gfs.Changes(changes[2].Seq, 100)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.Equal(t, OpRemove, changes[0].Op)
+	require.Equal(t, "/dir/file", changes[0].Name)
+	require.Equal(t, OpRemove, changes[1].Op)
+	require.Equal(t, "/dir", changes[1].Name)
+}